@@ -43,6 +43,11 @@ var (
 	logo   string
 	banner = fmt.Sprintf(logo, version, website)
 	daemon = false
+	// Skip corrupted segments instead of refusing to start, only meant for a one-off recovery
+	recoverSkipCorrupt = false
+	// wiredb upgrade --path rewrites the data files to the current format and exits
+	upgrade     = false
+	upgradePath = ""
 )
 
 // Initialize components needed globally,
@@ -51,6 +56,13 @@ var (
 // but they can set relatively fewer parameters.
 func init() {
 	color.RGB(255, 123, 34).Println(banner)
+
+	// The upgrade command runs offline and takes none of the server parameters
+	if len(os.Args) > 1 && os.Args[1] == "upgrade" {
+		parseUpgradeFlags(os.Args[2:])
+		return
+	}
+
 	fl := parseFlags()
 
 	if conf.HasCustom(fl.config) {
@@ -98,6 +110,11 @@ func init() {
 }
 
 func StartApp() {
+	if upgrade {
+		runUpgrade()
+		return
+	}
+
 	if daemon {
 		runAsDaemon()
 	} else {
@@ -128,26 +145,72 @@ func runServer() {
 		clog.Failed(err)
 	}
 
+	fsync, err := vfs.ParseFsyncPolicy(conf.Settings.Durability.Fsync)
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	// Encrypted keys are decrypted during recovery, the keyring is needed before opening
+	var (
+		encryptor vfs.Encryptor
+		keyring   *vfs.Keyring
+	)
+	if conf.Settings.IsEncryptionEnabled() {
+		// New data is encrypted with the configured cipher, older data keeps its own
+		encryptor, err = vfs.LookupEncryptor(conf.Settings.Cipher())
+		if err != nil {
+			clog.Failed(err)
+		}
+		// The active secret encrypts new data, retired secrets only decrypt older data
+		secrets, err := conf.Settings.Secrets()
+		if err != nil {
+			clog.Failed(err)
+		}
+		keyring, err = vfs.NewKeyring(secrets[0], secrets[1:]...)
+		if err != nil {
+			clog.Failed(err)
+		}
+	}
+
 	clog.Info("Loading and parsing region data files...")
 	fss, err := vfs.OpenFS(&vfs.Options{
 		FSPerm:    conf.FSPerm,
 		Path:      conf.Settings.Path,
 		Threshold: conf.Settings.Region.Threshold,
+		// Torn writes at the end of the newest region are always truncated during recovery
+		RecoverSkipCorrupt: recoverSkipCorrupt,
+		Fsync:              fsync,
+		FsyncInterval:      conf.Settings.FsyncInterval(),
+		GarbageRatio:       conf.Settings.Region.GarbageRatio,
+		MinGarbage:         conf.Settings.RegionMinGarbage(),
+		GCRateLimit:        conf.Settings.RegionGCRateLimit(),
+		Encryptor:          encryptor,
+		Keyring:            keyring,
+		EncryptKeys:        conf.Settings.IsKeyEncryptionEnabled(),
 	})
 	if err != nil {
 		clog.Failed(err)
 	}
 
-	if conf.Settings.IsCompressionEnabled() {
-		// Set file data to use Snappy compression algorithm
-		fss.SetCompressor(vfs.SnappyCompressor)
-		clog.Info("Snappy compression activated successfully")
+	if keyring != nil {
+		clog.Infof("Static encryptor %s activated with key %08x was successfully", conf.Settings.Cipher(), keyring.ActiveID())
+		if conf.Settings.IsKeyEncryptionEnabled() {
+			clog.Info("Key and index snapshot encryption activated successfully")
+		}
 	}
 
-	if conf.Settings.IsEncryptionEnabled() {
-		// Set file data to use AES cryptor algorithm
-		fss.SetEncryptor(vfs.AESCryptor, conf.Settings.Secret())
-		clog.Info("Static encryptor activated was successfully")
+	if conf.Settings.IsCompressionEnabled() {
+		compressor, err := vfs.LookupCompressor(conf.Settings.Algorithm())
+		if err != nil {
+			clog.Failed(err)
+		}
+		err = fss.SetCompressor(compressor)
+		if err != nil {
+			clog.Failed(err)
+		}
+		// Small values and values that do not shrink are stored uncompressed
+		fss.SetCompressionThreshold(conf.Settings.Compressor.Threshold)
+		clog.Infof("Static compressor %s activated was successfully", conf.Settings.Algorithm())
 	}
 
 	if conf.Settings.IsRegionGCEnabled() {
@@ -155,6 +218,13 @@ func runServer() {
 		clog.Info("Region compression activated successfully")
 	}
 
+	fss.StartExpireReaper(vfs.DefaultExpireInterval, vfs.DefaultExpireBatch)
+
+	if conf.Settings.IsCheckpointEnabled() {
+		fss.StartCheckpoint(conf.Settings.CheckpointInterval(), conf.Settings.Checkpoint.Writes)
+		clog.Info("Index checkpoint activated successfully")
+	}
+
 	if len(conf.Settings.AllowIP) > 0 {
 		hts.SetAllowIP(conf.Settings.AllowIP)
 		clog.Info("Setting whitelist IP successfully")
@@ -189,6 +259,45 @@ func runServer() {
 	os.Exit(0)
 }
 
+func runUpgrade() {
+	var legacy vfs.Codec
+	// Before format version 4 values were only ever compressed with Snappy
+	if conf.Settings.IsCompressionEnabled() {
+		legacy.Compressor = vfs.CodecSnappy
+	}
+	// Before format version 4 values were only ever encrypted with AES-CBC
+	if conf.Settings.IsEncryptionEnabled() {
+		legacy.Encryptor = vfs.CodecAESCBC
+		secrets, err := conf.Settings.Secrets()
+		if err != nil {
+			clog.Failed(err)
+		}
+		legacy.KeyID = vfs.KeyID(secrets[0])
+	}
+
+	clog.Infof("Upgrading data files in %s to format version %d...", upgradePath, vfs.FormatVersion)
+	upgraded, err := vfs.UpgradeFS(&vfs.Options{
+		FSPerm:    conf.FSPerm,
+		Path:      upgradePath,
+		Threshold: conf.Settings.Region.Threshold,
+	}, legacy, func(p vfs.UpgradeProgress) {
+		if p.Stage == vfs.UpgradeIndex {
+			clog.Info("Index snapshot rebuilt successfully")
+			return
+		}
+		clog.Infof("[%d/%d] %s region %d with %d segments", p.Done, p.Total, p.Stage, p.RegionID, p.Segments)
+	})
+	if err != nil {
+		clog.Failed(err)
+	}
+
+	if upgraded == 0 {
+		clog.Info("Data files are already in the current format")
+		return
+	}
+	clog.Infof("Upgraded %d regions successfully", upgraded)
+}
+
 type flags struct {
 	auth   string
 	port   int
@@ -205,6 +314,27 @@ func parseFlags() (fl *flags) {
 	flag.StringVar(&fl.config, "config", "", "--config the configuration file path.")
 	flag.IntVar(&fl.port, "port", conf.Default.Port, "--port the HTTP server port.")
 	flag.BoolVar(&daemon, "daemon", false, "--daemon run with a daemon.")
+	flag.BoolVar(&recoverSkipCorrupt, "recover-skip-corrupt", false, "--recover-skip-corrupt skip corrupted segments during recovery.")
 	flag.Parse()
 	return
 }
+
+func parseUpgradeFlags(args []string) {
+	upgrade = true
+	var config string
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	fs.StringVar(&upgradePath, "path", conf.Default.Path, "--path the data storage directory to upgrade.")
+	fs.StringVar(&config, "config", "", "--config the configuration file the data files were written with.")
+	_ = fs.Parse(args)
+
+	// Older data files do not record their compression and encryption settings
+	if conf.HasCustom(config) {
+		err := conf.Load(config, conf.Settings)
+		if err != nil {
+			clog.Failed(err)
+		}
+		if upgradePath == conf.Default.Path {
+			upgradePath = conf.Settings.Path
+		}
+	}
+}
@@ -3,9 +3,11 @@ package conf
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -29,20 +31,39 @@ const (
 		"region": {
 			"enable": true,
 			"second": 18000,
-			"threshold": 3
+			"threshold": 3,
+			"garbageratio": 0.5,
+			"mingarbage": 64,
+			"ratelimit": 0
+		},
+		"checkpoint": {
+			"enable": true,
+			"second": 300,
+			"writes": 100000
+		},
+		"durability": {
+			"fsync": "every-interval",
+			"second": 1
 		},
 		"encryptor": {
 			"enable": false,
+			"cipher": "aes-gcm",
 			"secret": "your-static-data-secret!"
 		},
 		"compressor": {
-			"enable": false
+			"enable": false,
+			"algorithm": "snappy",
+			"threshold": 64
 		},
 		"allow_ip": null
 	}
 `
 )
 
+// KeyringEnv names the environment variable holding the encryption secrets separated
+// by commas, the first one is the active secret. It takes precedence over the key file.
+const KeyringEnv = "WIREDB_KEYRING"
+
 var (
 	// Settings global configure options
 	Settings *ServerOptions = new(ServerOptions)
@@ -78,6 +99,24 @@ func (PortValidator) Validate(opt *ServerOptions) error {
 	return validatePort(opt.Port)
 }
 
+type CheckpointValidator struct{}
+
+func (CheckpointValidator) Validate(opt *ServerOptions) error {
+	return validateCheckpoint(opt.Checkpoint)
+}
+
+type DurabilityValidator struct{}
+
+func (DurabilityValidator) Validate(opt *ServerOptions) error {
+	return validateDurability(opt.Durability)
+}
+
+type RegionValidator struct{}
+
+func (RegionValidator) Validate(opt *ServerOptions) error {
+	return validateRegion(opt.Region)
+}
+
 type PathValidator struct{}
 
 func (PathValidator) Validate(opt *ServerOptions) error {
@@ -90,6 +129,24 @@ func (AuthValidator) Validate(opt *ServerOptions) error {
 	return validatePassword(opt.Password)
 }
 
+type CompressorValidator struct{}
+
+func (CompressorValidator) Validate(opt *ServerOptions) error {
+	return validateCompressor(opt.Compressor)
+}
+
+func validateCompressor(compressor Compressor) error {
+	switch compressor.Algorithm {
+	case "", "snappy", "deflate", "gzip":
+	default:
+		return fmt.Errorf("unsupported compressor algorithm: %s", compressor.Algorithm)
+	}
+	if compressor.Threshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	return nil
+}
+
 type EncryptorValidator struct{}
 
 func (EncryptorValidator) Validate(opt *ServerOptions) error {
@@ -100,10 +157,98 @@ func validateEncryptor(encryptor Encryptor) error {
 	if !encryptor.Enable {
 		return nil
 	}
-	if valid[len(encryptor.Secret)] {
+
+	_, err := encryptor.secrets()
+	return err
+}
+
+// validateSecret checks that secret can be used to encrypt new data with cipher.
+func validateSecret(cipher string, secret []byte) error {
+	switch cipher {
+	case "", "aes-gcm", "aes-cbc":
+		if valid[len(secret)] {
+			return nil
+		}
+		return errors.New("invalid secret key length it must be 16, 24, or 32 bytes")
+	case "chacha20-poly1305":
+		if len(secret) == 32 {
+			return nil
+		}
+		return errors.New("invalid secret key length chacha20-poly1305 requires 32 bytes")
+	default:
+		return fmt.Errorf("unsupported encryptor cipher: %s", cipher)
+	}
+}
+
+// secrets returns the active secret followed by the retired ones, read from the
+// KeyringEnv environment variable, the key file or the inline secret in that order.
+func (e Encryptor) secrets() ([][]byte, error) {
+	var secrets [][]byte
+	if env := os.Getenv(KeyringEnv); env != "" {
+		for _, secret := range strings.Split(env, ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				secrets = append(secrets, []byte(secret))
+			}
+		}
+	} else if e.KeyFile != "" {
+		data, err := os.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		// One secret per line, blank lines and lines starting with # are skipped.
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				secrets = append(secrets, []byte(line))
+			}
+		}
+	} else {
+		secrets = append(secrets, []byte(e.Secret))
+	}
+
+	if len(secrets) == 0 {
+		return nil, errors.New("no encryption secret is configured")
+	}
+
+	err := validateSecret(e.Cipher, secrets[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Retired secrets may have been used with any cipher.
+	for _, secret := range secrets[1:] {
+		if !valid[len(secret)] {
+			return nil, errors.New("invalid retired secret key length it must be 16, 24, or 32 bytes")
+		}
+	}
+
+	return secrets, nil
+}
+
+func validateCheckpoint(checkpoint Checkpoint) error {
+	if checkpoint.Enable && checkpoint.Second <= 0 {
+		return errors.New("checkpoint interval must be greater than 0 seconds")
+	}
+	return nil
+}
+
+func validateDurability(durability Durability) error {
+	switch durability.Fsync {
+	case "", "always", "os":
+		return nil
+	case "every-interval":
+		if durability.Second <= 0 {
+			return errors.New("fsync interval must be greater than 0 seconds")
+		}
 		return nil
 	}
-	return errors.New("invalid secret key length it must be 16, 24, or 32 bytes")
+	return errors.New("fsync policy must be one of always, every-interval or os")
+}
+
+func validateRegion(region Region) error {
+	if region.GarbageRatio != nil && (*region.GarbageRatio < 0 || *region.GarbageRatio > 1) {
+		return errors.New("region garbage ratio must be between 0 and 1")
+	}
+	return nil
 }
 
 func validatePort(port int) error {
@@ -132,7 +277,11 @@ func Vaildated(opt *ServerOptions) error {
 		PortValidator{},
 		PathValidator{},
 		AuthValidator{},
+		RegionValidator{},
+		CheckpointValidator{},
+		DurabilityValidator{},
 		EncryptorValidator{},
+		CompressorValidator{},
 	}
 
 	for _, validator := range validators {
@@ -193,10 +342,23 @@ func (opt *ServerOptions) IsCompressionEnabled() bool {
 	return opt.Compressor.Enable
 }
 
+// Algorithm returns the compressor new data is compressed with, snappy by default.
+func (opt *ServerOptions) Algorithm() string {
+	if opt.Compressor.Algorithm == "" {
+		return "snappy"
+	}
+	return opt.Compressor.Algorithm
+}
+
 func (opt *ServerOptions) IsEncryptionEnabled() bool {
 	return opt.Encryptor.Enable
 }
 
+// IsKeyEncryptionEnabled reports whether keys and the index snapshot are encrypted too.
+func (opt *ServerOptions) IsKeyEncryptionEnabled() bool {
+	return opt.Encryptor.Enable && opt.Encryptor.Keys
+}
+
 func (opt *ServerOptions) IsRegionGCEnabled() bool {
 	return opt.Region.Enable
 }
@@ -205,10 +367,46 @@ func (opt *ServerOptions) RegionGCInterval() time.Duration {
 	return time.Duration(opt.Region.Second) * time.Second
 }
 
+// RegionMinGarbage returns the minimum dead bytes of a region to be compacted.
+func (opt *ServerOptions) RegionMinGarbage() uint64 {
+	return opt.Region.MinGarbage * 1024 * 1024
+}
+
+// RegionGCRateLimit returns the compaction I/O budget in bytes per second, 0 is unlimited.
+func (opt *ServerOptions) RegionGCRateLimit() uint64 {
+	return opt.Region.RateLimit * 1024 * 1024
+}
+
+func (opt *ServerOptions) IsCheckpointEnabled() bool {
+	return opt.Checkpoint.Enable
+}
+
+func (opt *ServerOptions) CheckpointInterval() time.Duration {
+	return time.Duration(opt.Checkpoint.Second) * time.Second
+}
+
+func (opt *ServerOptions) FsyncInterval() time.Duration {
+	return time.Duration(opt.Durability.Second) * time.Second
+}
+
+// Secret returns the inline secret of the config file.
 func (opt *ServerOptions) Secret() []byte {
 	return []byte(opt.Encryptor.Secret)
 }
 
+// Secrets returns the active encryption secret followed by the retired ones.
+func (opt *ServerOptions) Secrets() ([][]byte, error) {
+	return opt.Encryptor.secrets()
+}
+
+// Cipher returns the name of the encryptor for new data, aes-gcm if none is set.
+func (opt *ServerOptions) Cipher() string {
+	if opt.Encryptor.Cipher == "" {
+		return "aes-gcm"
+	}
+	return opt.Encryptor.Cipher
+}
+
 func toString(opt *ServerOptions) string {
 	bs, _ := opt.Marshal()
 	return string(bs)
@@ -221,22 +419,60 @@ type ServerOptions struct {
 	LogPath    string     `json:"logpath"`
 	Password   string     `json:"auth"`
 	Region     Region     `json:"region"`
+	Checkpoint Checkpoint `json:"checkpoint"`
+	Durability Durability `json:"durability"`
 	Encryptor  Encryptor  `json:"encryptor"`
 	Compressor Compressor `json:"compressor"`
 	AllowIP    []string   `json:"allowip"`
 }
 
+// Region configures the data regions, a region is only compacted by the garbage
+// collector once its share of dead bytes reaches GarbageRatio and it holds at
+// least MinGarbage MB of dead bytes. GarbageRatio is nil when it is not configured,
+// the storage default applies then. RateLimit bounds the compaction I/O in MB
+// per second, 0 leaves it unlimited.
 type Region struct {
-	Enable    bool  `json:"enable"`
-	Second    int64 `json:"second"`
-	Threshold uint8 `json:"threshold"`
+	Enable       bool     `json:"enable"`
+	Second       int64    `json:"second"`
+	Threshold    uint8    `json:"threshold"`
+	GarbageRatio *float64 `json:"garbageratio,omitempty"`
+	MinGarbage   uint64   `json:"mingarbage"`
+	RateLimit    uint64   `json:"ratelimit"`
 }
 
-type Encryptor struct {
+// Checkpoint exports index snapshots every Second seconds,
+// or after Writes writes when Writes is greater than 0.
+type Checkpoint struct {
 	Enable bool   `json:"enable"`
-	Secret string `json:"secret"`
+	Second int64  `json:"second"`
+	Writes uint64 `json:"writes"`
+}
+
+// Durability decides when written data is flushed to disk, Fsync is one of
+// always, every-interval or os, Second is the flush period of every-interval.
+type Durability struct {
+	Fsync  string `json:"fsync"`
+	Second int64  `json:"second"`
+}
+
+// Encryptor encrypts new data with Cipher, one of aes-gcm, chacha20-poly1305 or aes-cbc.
+// Data written before is still decrypted with the cipher it was written with.
+// KeyFile holds the active secret on its first line and the retired ones below it,
+// it keeps the secrets out of the config file. Secret is only used without KeyFile.
+// Keys also encrypts the keys of the data and the index snapshot.
+type Encryptor struct {
+	Enable  bool   `json:"enable"`
+	Cipher  string `json:"cipher,omitempty"`
+	Secret  string `json:"secret"`
+	KeyFile string `json:"keyfile,omitempty"`
+	Keys    bool   `json:"keys,omitempty"`
 }
 
+// Compressor compresses new data with Algorithm, one of snappy, deflate or gzip.
+// Data shorter than Threshold bytes or that does not get smaller is stored as is,
+// every value records whether and how it was compressed.
 type Compressor struct {
-	Enable bool `json:"enable"`
+	Enable    bool   `json:"enable"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
 }
@@ -51,6 +51,36 @@ func TestConfigLoad(t *testing.T) {
 	}
 }
 
+// TestConfigLoadRegion tests that the garbage collection keys of the region are loaded
+func TestConfigLoadRegion(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "test-config.yaml")
+	testConfigData := []byte(`
+region:
+    garbageratio: 0
+    mingarbage: 16
+    ratelimit: 8
+`)
+	assert.NoError(t, os.WriteFile(configFile, testConfigData, 0644))
+
+	loadedConfig := new(ServerOptions)
+	assert.NoError(t, loadedConfig.Unmarshal([]byte(DefaultConfigJSON)))
+	assert.NoError(t, Load(configFile, loadedConfig))
+	assert.Equal(t, 0.0, *loadedConfig.Region.GarbageRatio)
+	assert.Equal(t, uint64(16), loadedConfig.Region.MinGarbage)
+	assert.Equal(t, uint64(8), loadedConfig.Region.RateLimit)
+
+	// 没有配置 garbageratio 的时候保持未设置，由存储使用默认的比例
+	assert.NoError(t, os.WriteFile(configFile, []byte("region:\n    mingarbage: 16\n"), 0644))
+	loadedConfig = new(ServerOptions)
+	assert.NoError(t, Load(configFile, loadedConfig))
+	assert.Nil(t, loadedConfig.Region.GarbageRatio)
+
+	loadedConfig = new(ServerOptions)
+	assert.NoError(t, loadedConfig.Unmarshal([]byte(DefaultConfigJSON)))
+	assert.NoError(t, Load(configFile, loadedConfig))
+	assert.Equal(t, 0.5, *loadedConfig.Region.GarbageRatio)
+}
+
 func TestConfigLoad_Error(t *testing.T) {
 
 	// 创建一个临时目录用于测试
@@ -467,7 +497,7 @@ func TestMarshal(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify the marshaled data is correct
-	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","debug":false,"logpath":"","auth":"testpassword","region":{"enable":false,"second":0,"threshold":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"allowip":null}`
+	expectedJSON := `{"port":8080,"path":"/tmp/myconfig","debug":false,"logpath":"","auth":"testpassword","region":{"enable":false,"second":0,"threshold":0,"mingarbage":0,"ratelimit":0},"checkpoint":{"enable":false,"second":0,"writes":0},"durability":{"fsync":"","second":0},"encryptor":{"enable":false,"secret":""},"compressor":{"enable":false},"allowip":null}`
 	assert.JSONEq(t, expectedJSON, string(data))
 }
 
@@ -494,7 +524,9 @@ func TestServerOptionsMethods(t *testing.T) {
 	opt := &ServerOptions{
 		Compressor: Compressor{Enable: true},
 		Encryptor:  Encryptor{Enable: true, Secret: "secure-key-12345678"},
-		Region:     Region{Enable: true, Second: 1800},
+		Region:     Region{Enable: true, Second: 1800, MinGarbage: 64, RateLimit: 16},
+		Checkpoint: Checkpoint{Enable: true, Second: 300, Writes: 1000},
+		Durability: Durability{Fsync: "every-interval", Second: 2},
 	}
 
 	// 1. 测试 IsCompressionEnabled 方法
@@ -518,9 +550,137 @@ func TestServerOptionsMethods(t *testing.T) {
 		assert.Equal(t, expectedDuration, opt.RegionGCInterval())
 	})
 
-	// 5. 测试 Secret 方法
+	// 5. 测试 IsCheckpointEnabled 和 CheckpointInterval 方法
+	t.Run("Test Checkpoint", func(t *testing.T) {
+		assert.True(t, opt.IsCheckpointEnabled())
+		assert.Equal(t, 300*time.Second, opt.CheckpointInterval())
+	})
+
+	// 6. 测试 RegionMinGarbage 方法
+	t.Run("Test RegionMinGarbage", func(t *testing.T) {
+		assert.Equal(t, uint64(64*1024*1024), opt.RegionMinGarbage())
+	})
+
+	// 7. 测试 RegionGCRateLimit 方法
+	t.Run("Test RegionGCRateLimit", func(t *testing.T) {
+		assert.Equal(t, uint64(16*1024*1024), opt.RegionGCRateLimit())
+	})
+
+	// 8. 测试 FsyncInterval 方法
+	t.Run("Test FsyncInterval", func(t *testing.T) {
+		assert.Equal(t, 2*time.Second, opt.FsyncInterval())
+	})
+
+	// 9. 测试 Secret 方法
 	t.Run("Test Secret", func(t *testing.T) {
 		expectedSecret := []byte("secure-key-12345678")
 		assert.Equal(t, expectedSecret, opt.Secret())
 	})
 }
+
+// TestValidateCheckpoint tests the checkpoint interval validation
+func TestValidateCheckpoint(t *testing.T) {
+	assert.NoError(t, validateCheckpoint(Checkpoint{Enable: false}))
+	assert.NoError(t, validateCheckpoint(Checkpoint{Enable: true, Second: 60}))
+
+	err := validateCheckpoint(Checkpoint{Enable: true, Second: 0})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checkpoint interval must be greater than 0 seconds")
+}
+
+// TestValidateDurability tests the fsync policy validation
+func TestValidateDurability(t *testing.T) {
+	assert.NoError(t, validateDurability(Durability{Fsync: "always"}))
+	assert.NoError(t, validateDurability(Durability{Fsync: "os"}))
+	assert.NoError(t, validateDurability(Durability{Fsync: "every-interval", Second: 1}))
+
+	err := validateDurability(Durability{Fsync: "every-interval"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fsync interval must be greater than 0 seconds")
+
+	err = validateDurability(Durability{Fsync: "never"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fsync policy must be one of")
+}
+
+// TestValidateRegion tests the garbage ratio validation
+func TestValidateRegion(t *testing.T) {
+	ratio := func(r float64) *float64 { return &r }
+	assert.NoError(t, validateRegion(Region{GarbageRatio: ratio(0.5)}))
+	assert.NoError(t, validateRegion(Region{GarbageRatio: ratio(0)}))
+	assert.NoError(t, validateRegion(Region{}))
+
+	err := validateRegion(Region{GarbageRatio: ratio(1.5)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "region garbage ratio must be between 0 and 1")
+}
+
+// TestValidateEncryptor tests the cipher and secret length validation
+func TestValidateEncryptor(t *testing.T) {
+	assert.NoError(t, validateEncryptor(Encryptor{Enable: true, Secret: "1234567890123456"}))
+	assert.NoError(t, validateEncryptor(Encryptor{Enable: true, Cipher: "aes-cbc", Secret: "1234567890123456"}))
+	assert.NoError(t, validateEncryptor(Encryptor{Enable: true, Cipher: "chacha20-poly1305", Secret: "12345678901234567890123456789012"}))
+
+	err := validateEncryptor(Encryptor{Enable: true, Cipher: "chacha20-poly1305", Secret: "1234567890123456"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "chacha20-poly1305 requires 32 bytes")
+
+	err = validateEncryptor(Encryptor{Enable: true, Cipher: "des", Secret: "1234567890123456"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported encryptor cipher")
+
+	assert.Equal(t, "aes-gcm", (&ServerOptions{}).Cipher())
+}
+
+// TestValidateCompressor tests the algorithm and threshold validation
+func TestValidateCompressor(t *testing.T) {
+	assert.NoError(t, validateCompressor(Compressor{Enable: true}))
+	assert.NoError(t, validateCompressor(Compressor{Enable: true, Algorithm: "gzip", Threshold: 128}))
+
+	err := validateCompressor(Compressor{Enable: true, Algorithm: "brotli"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported compressor algorithm")
+
+	err = validateCompressor(Compressor{Enable: true, Threshold: -1})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "compression threshold must not be negative")
+
+	assert.Equal(t, "snappy", (&ServerOptions{}).Algorithm())
+}
+
+func TestSecrets(t *testing.T) {
+	active := "12345678901234567890123456789012"
+	retired := "1234567890123456"
+
+	// 没有密钥文件的时候使用配置文件中的密钥
+	opt := &ServerOptions{Encryptor: Encryptor{Enable: true, Secret: retired}}
+	secrets, err := opt.Secrets()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(retired)}, secrets)
+
+	// 密钥文件的第一行是当前密钥，空行和注释会被跳过
+	keyfile := filepath.Join(t.TempDir(), "keyring")
+	assert.NoError(t, os.WriteFile(keyfile, []byte("# rotated\n"+active+"\n\n"+retired+"\n"), 0600))
+	opt.Encryptor = Encryptor{Enable: true, Cipher: "chacha20-poly1305", KeyFile: keyfile}
+	secrets, err = opt.Secrets()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(active), []byte(retired)}, secrets)
+	assert.NoError(t, validateEncryptor(opt.Encryptor))
+
+	// 环境变量的优先级高于密钥文件
+	t.Setenv(KeyringEnv, retired+", "+active)
+	_, err = opt.Secrets()
+	assert.Error(t, err)
+	opt.Encryptor.Cipher = "aes-gcm"
+	secrets, err = opt.Secrets()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(retired), []byte(active)}, secrets)
+
+	t.Setenv(KeyringEnv, active+",short")
+	_, err = opt.Secrets()
+	assert.Error(t, err)
+
+	t.Setenv(KeyringEnv, "")
+	opt.Encryptor.KeyFile = filepath.Join(t.TempDir(), "missing")
+	assert.Error(t, validateEncryptor(opt.Encryptor))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/auula/wiredkv/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// curl -X POST http://192.168.31.221:2668/admin/gc \
+//      -H "Content-Type: application/json" \
+//      -H "Auth-Token: 11111" \
+//      -d '{"regions": [1, 2]}'
+//
+// The run goes on in the background, its progress and result are returned by:
+//
+// curl -X GET http://192.168.31.221:2668/admin/gc -H "Auth-Token: 11111"
+//
+// After a key rotation the values of retired secrets are encrypted again with:
+//
+// curl -X POST http://192.168.31.221:2668/admin/gc \
+//      -H "Content-Type: application/json" \
+//      -H "Auth-Token: 11111" \
+//      -d '{"reencrypt": true}'
+
+// GCRequest is the optional body of POST /admin/gc, without regions the
+// regions that meet the garbage thresholds are compacted. Reencrypt compacts
+// the regions holding values that are not encrypted with the active secret.
+type GCRequest struct {
+	Regions   []uint64 `json:"regions"`
+	Reencrypt bool     `json:"reencrypt"`
+}
+
+// GCResumeRequest is the optional body of POST /admin/gc/resume, without
+// second the interval of the last started worker is used.
+type GCResumeRequest struct {
+	Second int64 `json:"second"`
+}
+
+// GCLimitRequest is the body of PUT /admin/gc/limit, 0 removes the limit.
+type GCLimitRequest struct {
+	BytesPerSecond *uint64 `json:"bytes_per_second"`
+}
+
+func GetGCController(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, storage.GCStats())
+}
+
+func RunGCController(ctx *gin.Context) {
+	var req GCRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if req.Reencrypt && len(req.Regions) > 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "regions can not be combined with reencrypt"})
+		return
+	}
+
+	// Compacting large regions outlives the write timeout of the server,
+	// the run goes on in the background and is followed with GET /admin/gc.
+	err = storage.StartRegionGCRun(req.Reencrypt, req.Regions...)
+	if errors.Is(err, vfs.ErrGCRunning) {
+		ctx.JSON(http.StatusConflict, gin.H{"message": err.Error(), "gc": storage.GCStats()})
+		return
+	}
+
+	if errors.Is(err, vfs.ErrInvalidRegion) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "garbage collection started.",
+		"gc":      storage.GCStats(),
+	})
+}
+
+func PauseGCController(ctx *gin.Context) {
+	// A running garbage collection is finished before the worker stops.
+	storage.StopRegionGC()
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "garbage collection paused.",
+		"gc":      storage.GCStats(),
+	})
+}
+
+func ResumeGCController(ctx *gin.Context) {
+	var req GCResumeRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	interval := storage.RegionGCInterval()
+	if req.Second > 0 {
+		interval = time.Duration(req.Second) * time.Second
+	}
+
+	if interval <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "garbage collection interval is not configured.",
+		})
+		return
+	}
+
+	// A running worker keeps its interval, it has to be paused first.
+	storage.StartRegionGC(interval)
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "garbage collection resumed.",
+		"gc":      storage.GCStats(),
+	})
+}
+
+func PutGCLimitController(ctx *gin.Context) {
+	var req GCLimitRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if req.BytesPerSecond == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "bytes_per_second is required."})
+		return
+	}
+
+	storage.SetGCRateLimit(*req.BytesPerSecond)
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "garbage collection rate limit updated.",
+		"gc":      storage.GCStats(),
+	})
+}
@@ -21,6 +21,17 @@ var (
 // POST 创建 http://192.168.101.225:2668/zset/user-01-score
 // PUT  更新 http://192.168.101.225:2668/zset/user-01-score
 // GET  获取 http://192.168.101.225:2668/table/user-01-shop-cart
+// GET  遍历 http://192.168.101.225:2668/keys?match=user-*&type=table&count=100&cursor=xxx
+// GET  变更 http://192.168.101.225:2668/changes?since=0&count=100 按写入顺序返回 since 之后的修改，next 作为下一次的 since
+// 写入请求携带 Durability: sync 请求头时，响应之前数据已经持久化到磁盘
+// POST 事务 http://192.168.101.225:2668/tx 读取的键和条件在提交之前没有被修改才会写入，否则返回 409
+// GET  回收 http://192.168.101.225:2668/admin/gc 垃圾回收的状态和最近一次运行的结果
+// POST 回收 http://192.168.101.225:2668/admin/gc 立即压缩数据文件，可以指定 {"regions": [1, 2]}
+// POST 回收 http://192.168.101.225:2668/admin/gc/pause 暂停后台垃圾回收，/admin/gc/resume 恢复
+// PUT  回收 http://192.168.101.225:2668/admin/gc/limit 调整垃圾回收每秒读写的字节数 {"bytes_per_second": 0}
+// GET  过期 http://192.168.101.225:2668/ttl/user-01-shop-cart 剩余的秒数，没有过期时间返回 -1
+// PUT  过期 http://192.168.101.225:2668/ttl/user-01-shop-cart 设置 {"ttl": 60} 或者延长 {"extend": 60} 过期时间
+// DELETE 过期 http://192.168.101.225:2668/ttl/user-01-shop-cart 移除过期时间，数据永久保存
 
 func init() {
 	gin.SetMode(gin.ReleaseMode)
@@ -29,6 +40,25 @@ func init() {
 	root.Use(authMiddleware())
 	root.NoRoute(Error404Handler)
 	root.GET("/", GetHealthController)
+	root.GET("/keys", GetKeysController)
+	root.GET("/changes", GetChangesController)
+	root.POST("/tx", TransactionController)
+
+	admin := root.Group("/admin")
+	{
+		admin.GET("/gc", GetGCController)
+		admin.POST("/gc", RunGCController)
+		admin.POST("/gc/pause", PauseGCController)
+		admin.POST("/gc/resume", ResumeGCController)
+		admin.PUT("/gc/limit", PutGCLimitController)
+	}
+
+	ttl := root.Group("/ttl")
+	{
+		ttl.GET("/:key", GetTTLController)
+		ttl.PUT("/:key", PutTTLController)
+		ttl.DELETE("/:key", DeleteTTLController)
+	}
 
 	set := root.Group("/set")
 	{
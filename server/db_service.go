@@ -1,8 +1,10 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/auula/wiredkv/types"
 	"github.com/auula/wiredkv/utils"
@@ -15,9 +17,7 @@ var storage *vfs.LogStructuredFS
 func GetListController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -31,6 +31,7 @@ func GetListController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"list": list.List,
+		"ttl":  ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -44,13 +45,13 @@ func PutListController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, list, list.TTL)
+	seg, err := newSegment(key, list, list.TTL, list.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -64,7 +65,7 @@ func PutListController(ctx *gin.Context) {
 func DeleteListController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -79,9 +80,7 @@ func DeleteListController(ctx *gin.Context) {
 func GetTableController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -95,6 +94,7 @@ func GetTableController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"table": table.Table,
+		"ttl":   ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -108,13 +108,13 @@ func PutTableController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, table, table.TTL)
+	seg, err := newSegment(key, table, table.TTL, table.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -128,7 +128,7 @@ func PutTableController(ctx *gin.Context) {
 func DeleteTableController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -143,9 +143,7 @@ func DeleteTableController(ctx *gin.Context) {
 func GetZsetController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -159,6 +157,7 @@ func GetZsetController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"list": zset.ZSet,
+		"ttl":  ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -172,13 +171,13 @@ func PutZsetController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, zset, zset.TTL)
+	seg, err := newSegment(key, zset, zset.TTL, zset.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -192,7 +191,7 @@ func PutZsetController(ctx *gin.Context) {
 func DeleteZsetController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -207,9 +206,7 @@ func DeleteZsetController(ctx *gin.Context) {
 func GetTextController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -223,6 +220,7 @@ func GetTextController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"text": text.Content,
+		"ttl":  ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -236,13 +234,13 @@ func PutTextController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, text, text.TTL)
+	seg, err := newSegment(key, text, text.TTL, text.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -256,7 +254,7 @@ func PutTextController(ctx *gin.Context) {
 func DeleteTextController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -271,9 +269,7 @@ func DeleteTextController(ctx *gin.Context) {
 func GetNumberController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -287,6 +283,7 @@ func GetNumberController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"number": number.Value,
+		"ttl":    ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -300,13 +297,13 @@ func PutNumberController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, number, number.TTL)
+	seg, err := newSegment(key, number, number.TTL, number.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -320,7 +317,7 @@ func PutNumberController(ctx *gin.Context) {
 func DeleteNumberController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -335,9 +332,7 @@ func DeleteNumberController(ctx *gin.Context) {
 func GetSetController(ctx *gin.Context) {
 	_, seg, err := storage.FetchSegment(ctx.Param("key"))
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"message": "key data not found.",
-		})
+		fetchError(ctx, err)
 		return
 	}
 
@@ -351,6 +346,7 @@ func GetSetController(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"set": set.Set,
+		"ttl": ttlSeconds(seg.TTL()),
 	})
 }
 
@@ -364,13 +360,13 @@ func PutSetController(ctx *gin.Context) {
 		return
 	}
 
-	seg, err := vfs.NewSegment(key, set, set.TTL)
+	seg, err := newSegment(key, set, set.TTL, set.SlidingTTL)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
 
-	err = storage.PutSegment(key, seg)
+	err = putSegment(ctx, key, seg)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -384,7 +380,7 @@ func PutSetController(ctx *gin.Context) {
 func DeleteSetController(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	err := storage.DeleteSegment(key)
+	err := deleteSegment(ctx, key)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
@@ -396,6 +392,138 @@ func DeleteSetController(ctx *gin.Context) {
 	})
 }
 
+// GetKeysController pages through the keyspace with a resumable cursor,
+// the returned cursor is passed back to fetch the next page until it is empty.
+func GetKeysController(ctx *gin.Context) {
+	opt := &vfs.ScanOptions{
+		Prefix: ctx.Query("prefix"),
+		Match:  ctx.Query("match"),
+		Count:  vfs.DefaultScanCount,
+	}
+
+	if name := ctx.Query("type"); name != "" {
+		kind, err := vfs.ParseKind(name)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		opt.Kinds = []vfs.Kind{kind}
+	}
+
+	if count := ctx.Query("count"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "count must be a positive integer."})
+			return
+		}
+		opt.Count = n
+	}
+
+	cursor, keys, err := storage.Scan(ctx.Query("cursor"), opt)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if keys == nil {
+		keys = []string{}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"cursor": cursor,
+		"keys":   keys,
+	})
+}
+
+// GetChangesController returns the writes and deletions after the log sequence
+// number since in the order they were made, next is passed as since to continue.
+func GetChangesController(ctx *gin.Context) {
+	var since uint64
+	if value := ctx.Query("since"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "since must be a log sequence number."})
+			return
+		}
+		since = n
+	}
+
+	count := vfs.DefaultChangeCount
+	if value := ctx.Query("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "count must be a positive integer."})
+			return
+		}
+		count = n
+	}
+
+	changes, next, err := storage.ReadChanges(since, count)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	if changes == nil {
+		changes = []vfs.Change{}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"changes": changes,
+		"next":    next,
+	})
+}
+
+// DurabilityHeader asks for a write to be flushed to disk before the response,
+// whatever the fsync policy of the server is.
+const DurabilityHeader = "Durability"
+
+// fetchError answers a failed read, only a missing or expired key is reported as
+// not found, a read or decryption failure is an error of the server.
+func fetchError(ctx *gin.Context, err error) {
+	if !errors.Is(err, vfs.ErrKeyNotFound) {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusNotFound, gin.H{
+		"message": "key data not found.",
+	})
+}
+
+// newSegment builds the segment of a write, a sliding_ttl takes precedence over
+// a fixed ttl and renews the expiration of the key every time it is read.
+func newSegment(key string, data vfs.Serializable, ttl, sliding uint64) (*vfs.Segment, error) {
+	if sliding > 0 {
+		return vfs.NewSlidingSegment(key, data, sliding)
+	}
+	return vfs.NewSegment(key, data, ttl)
+}
+
+func putSegment(ctx *gin.Context, key string, seg *vfs.Segment) error {
+	err := storage.PutSegment(key, seg)
+	if err != nil {
+		return err
+	}
+	return durable(ctx)
+}
+
+func deleteSegment(ctx *gin.Context, key string) error {
+	err := storage.DeleteSegment(key)
+	if err != nil {
+		return err
+	}
+	return durable(ctx)
+}
+
+// durable flushes the written segments when the request carries "Durability: sync",
+// concurrent requests share the same fsync through the group commit of the storage.
+func durable(ctx *gin.Context) error {
+	if ctx.GetHeader(DurabilityHeader) != "sync" {
+		return nil
+	}
+	return storage.Sync()
+}
+
 func GetHealthController(ctx *gin.Context) {
 	health, err := newHealth(storage.GetDirectory())
 	if err != nil {
@@ -2,10 +2,14 @@ package server
 
 import (
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/auula/wiredkv/vfs"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -111,3 +115,16 @@ func TestHttpServer_Shutdown(t *testing.T) {
 	err = hts.Shutdown()
 	assert.NoError(t, err)
 }
+
+// 超出范围的 TTL 是错误的请求
+func TestPutTTLControllerOutOfRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Params = gin.Params{{Key: "key", Value: "key-01"}}
+	ctx.Request = httptest.NewRequest(http.MethodPut, "/ttl/key-01", strings.NewReader(`{"ttl": 9223372036854775807}`))
+	ctx.Request.Header.Set("Content-Type", "application/json")
+
+	PutTTLController(ctx)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
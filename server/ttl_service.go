@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/auula/wiredkv/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// curl -X PUT http://192.168.31.221:2668/ttl/user-01-shop-cart \
+//      -H "Content-Type: application/json" \
+//      -H "Auth-Token: 11111" \
+//      -d '{"ttl": 3600}'
+
+// maxTTLSeconds is the longest ttl or extend that converts to a time.Duration.
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// TTLRequest is the body of PUT /ttl/{key}, ttl sets the key to expire ttl seconds
+// from now and extend adds seconds to the remaining TTL. Exactly one must be set.
+type TTLRequest struct {
+	TTL    *int64 `json:"ttl"`
+	Extend *int64 `json:"extend"`
+}
+
+func GetTTLController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	ttl, err := storage.SegmentTTL(key)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"message": "key data not found.",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"key": key,
+		"ttl": ttlSeconds(ttl),
+	})
+}
+
+func PutTTLController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var req TTLRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if (req.TTL != nil && *req.TTL > maxTTLSeconds) || (req.Extend != nil && *req.Extend > maxTTLSeconds) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "ttl and extend must not exceed the maximum number of seconds.",
+		})
+		return
+	}
+
+	var expiredAt uint64
+	switch {
+	case req.TTL != nil && req.Extend == nil && *req.TTL > 0:
+		expiredAt, err = storage.ExpireSegment(key, time.Duration(*req.TTL)*time.Second)
+	case req.Extend != nil && req.TTL == nil && *req.Extend > 0:
+		expiredAt, err = storage.ExtendSegment(key, time.Duration(*req.Extend)*time.Second)
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "either ttl or extend must be a positive number of seconds.",
+		})
+		return
+	}
+
+	if err != nil {
+		ttlError(ctx, err)
+		return
+	}
+
+	err = durable(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"key": key,
+		"ttl": ttlSeconds(int64(expiredAt) - time.Now().UnixNano()),
+	})
+}
+
+func DeleteTTLController(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	err := storage.PersistSegment(key)
+	if err != nil {
+		ttlError(ctx, err)
+		return
+	}
+
+	err = durable(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"key": key,
+		"ttl": -1,
+	})
+}
+
+func ttlError(ctx *gin.Context, err error) {
+	if errors.Is(err, vfs.ErrKeyNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": "key data not found."})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+}
+
+// ttlSeconds converts the remaining nanoseconds of Segment.TTL to whole seconds,
+// rounded up so a key that is still alive never reports 0. -1 means no TTL.
+func ttlSeconds(ttl int64) int64 {
+	if ttl < 0 {
+		return -1
+	}
+	return (ttl + int64(time.Second) - 1) / int64(time.Second)
+}
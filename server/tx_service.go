@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/auula/wiredkv/types"
+	"github.com/auula/wiredkv/vfs"
+	"github.com/gin-gonic/gin"
+)
+
+// curl -X POST http://192.168.31.221:2668/tx \
+//      -H "Content-Type: application/json" \
+//      -H "Auth-Token: 11111" \
+//      -d '{
+//        "reads": ["user:1"],
+//        "conditions": [
+//          {"key": "users", "version": 12, "exists": true},
+//          {"key": "lock:user:1", "exists": false}
+//        ],
+//        "writes": [
+//          {"op": "put", "type": "table", "key": "user:1", "data": {"table": {"name": "wiredb"}}},
+//          {"op": "put", "type": "set", "key": "users", "data": {"set": {"user:1": true}}},
+//          {"op": "delete", "key": "user:0"}
+//        ]
+//      }'
+
+// Transaction is the request body of POST /tx. The keys in Reads are returned with
+// their version and are watched like Conditions, the Writes are only applied if
+// none of the watched keys has changed in the meantime.
+type Transaction struct {
+	Reads      []string       `json:"reads"`
+	Conditions []TxCondition  `json:"conditions"`
+	Writes     []TxWriteEntry `json:"writes"`
+}
+
+// TxCondition expects a key to be at Version, or to be absent when Exists is false.
+type TxCondition struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Exists  bool   `json:"exists"`
+}
+
+// TxWriteEntry is a put or a delete, Data has the same layout as the body of the PUT endpoint of Type.
+type TxWriteEntry struct {
+	Op   string          `json:"op"`
+	Type string          `json:"type"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data"`
+}
+
+// TxRead is the state of a key read by a transaction.
+type TxRead struct {
+	Key     string `json:"key"`
+	Exists  bool   `json:"exists"`
+	Version uint64 `json:"version"`
+	Type    string `json:"type,omitempty"`
+	Value   any    `json:"value,omitempty"`
+}
+
+func TransactionController(ctx *gin.Context) {
+	var tx Transaction
+	err := ctx.ShouldBindJSON(&tx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	batch := vfs.NewWriteBatch()
+	for _, write := range tx.Writes {
+		err := addTxWrite(batch, &write)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	watches := make([]vfs.Watch, 0, len(tx.Reads)+len(tx.Conditions))
+	for _, cond := range tx.Conditions {
+		watches = append(watches, vfs.Watch{Key: cond.Key, Version: cond.Version, Exists: cond.Exists})
+	}
+
+	reads := make([]TxRead, 0, len(tx.Reads))
+	for _, key := range tx.Reads {
+		read := TxRead{Key: key}
+		version, seg, err := storage.FetchSegment(key)
+		// Only a missing key is watched as absent, a failed read would make
+		// the transaction conflict forever.
+		if err != nil && !errors.Is(err, vfs.ErrKeyNotFound) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		if err == nil {
+			read.Value, err = segmentValue(seg)
+			if err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+				return
+			}
+			read.Exists, read.Version, read.Type = true, version, seg.Type.String()
+		}
+		reads = append(reads, read)
+		watches = append(watches, vfs.Watch{Key: key, Version: read.Version, Exists: read.Exists})
+	}
+
+	err = storage.WriteBatchIf(watches, batch)
+	if err == nil && batch.Len() > 0 {
+		err = durable(ctx)
+	}
+
+	var conflict *vfs.ConflictError
+	if errors.As(err, &conflict) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message":   "transaction conflict.",
+			"conflicts": conflict.Keys,
+		})
+		return
+	}
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "transaction committed.",
+		"reads":   reads,
+	})
+}
+
+func addTxWrite(batch *vfs.WriteBatch, write *TxWriteEntry) error {
+	if write.Key == "" {
+		return errors.New("transaction write key cannot be empty")
+	}
+
+	switch write.Op {
+	case "delete":
+		batch.Delete(write.Key)
+		return nil
+	case "put":
+		kind, err := vfs.ParseKind(write.Type)
+		if err != nil {
+			return err
+		}
+		seg, err := newSegmentFromJSON(write.Key, kind, write.Data)
+		if err != nil {
+			return fmt.Errorf("invalid data of key %s: %w", write.Key, err)
+		}
+		batch.Put(write.Key, seg)
+		return nil
+	}
+	return fmt.Errorf("unsupported transaction operation: %s", write.Op)
+}
+
+// newSegmentFromJSON decodes data with the layout of the PUT endpoint of kind.
+func newSegmentFromJSON(key string, kind vfs.Kind, data json.RawMessage) (*vfs.Segment, error) {
+	switch kind {
+	case vfs.Set:
+		var set types.Set
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, err
+		}
+		return newSegment(key, set, set.TTL, set.SlidingTTL)
+	case vfs.ZSet:
+		var zset types.ZSet
+		if err := json.Unmarshal(data, &zset); err != nil {
+			return nil, err
+		}
+		return newSegment(key, zset, zset.TTL, zset.SlidingTTL)
+	case vfs.List:
+		var list types.List
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		return newSegment(key, list, list.TTL, list.SlidingTTL)
+	case vfs.Text:
+		var text types.Text
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil, err
+		}
+		return newSegment(key, text, text.TTL, text.SlidingTTL)
+	case vfs.Table:
+		var table types.Table
+		if err := json.Unmarshal(data, &table); err != nil {
+			return nil, err
+		}
+		return newSegment(key, table, table.TTL, table.SlidingTTL)
+	case vfs.Number:
+		var number types.Number
+		if err := json.Unmarshal(data, &number); err != nil {
+			return nil, err
+		}
+		return newSegment(key, number, number.TTL, number.SlidingTTL)
+	}
+	return nil, fmt.Errorf("unsupported data type: %s", kind)
+}
+
+// segmentValue returns the value of a segment as returned by the GET endpoint of its type.
+func segmentValue(seg *vfs.Segment) (any, error) {
+	switch seg.Type {
+	case vfs.Set:
+		set, err := seg.ToSet()
+		if err != nil {
+			return nil, err
+		}
+		return set.Set, nil
+	case vfs.ZSet:
+		zset, err := seg.ToZSet()
+		if err != nil {
+			return nil, err
+		}
+		return zset.ZSet, nil
+	case vfs.List:
+		list, err := seg.ToList()
+		if err != nil {
+			return nil, err
+		}
+		return list.List, nil
+	case vfs.Text:
+		text, err := seg.ToText()
+		if err != nil {
+			return nil, err
+		}
+		return text.Content, nil
+	case vfs.Table:
+		table, err := seg.ToTable()
+		if err != nil {
+			return nil, err
+		}
+		return table.Table, nil
+	case vfs.Number:
+		number, err := seg.ToNumber()
+		if err != nil {
+			return nil, err
+		}
+		return number.Value, nil
+	}
+	return nil, fmt.Errorf("unsupported data type: %s", seg.Type)
+}
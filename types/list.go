@@ -7,8 +7,9 @@ import (
 )
 
 type List struct {
-	List []any  `json:"list" bson:"list" binding:"required"`
-	TTL  uint64 `json:"ttl,omitempty"`
+	List       []any  `json:"list" bson:"list" binding:"required"`
+	TTL        uint64 `json:"ttl,omitempty"`
+	SlidingTTL uint64 `json:"sliding_ttl,omitempty"`
 }
 
 func NewList() *List {
@@ -63,6 +64,7 @@ func (ls *List) Size() int {
 
 func (ls *List) Clear() {
 	ls.TTL = 0
+	ls.SlidingTTL = 0
 	ls.List = make([]any, 0)
 }
 
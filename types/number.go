@@ -8,8 +8,9 @@ import (
 
 // Number 结构体，表示带有数值的类型，支持原子操作
 type Number struct {
-	Value int64  `json:"number" bson:"number" binding:"required"`
-	TTL   uint64 `json:"ttl,omitempty"`
+	Value      int64  `json:"number" bson:"number" binding:"required"`
+	TTL        uint64 `json:"ttl,omitempty"`
+	SlidingTTL uint64 `json:"sliding_ttl,omitempty"`
 }
 
 func NewNumber(num int64) *Number {
@@ -3,8 +3,9 @@ package types
 import "gopkg.in/mgo.v2/bson"
 
 type Set struct {
-	Set map[string]bool `json:"set" bson:"set" binding:"required"`
-	TTL uint64          `json:"ttl,omitempty"`
+	Set        map[string]bool `json:"set" bson:"set" binding:"required"`
+	TTL        uint64          `json:"ttl,omitempty"`
+	SlidingTTL uint64          `json:"sliding_ttl,omitempty"`
 }
 
 // 新建一个 Set
@@ -37,6 +38,7 @@ func (s *Set) Size() int {
 // 清空 Set
 func (s *Set) Clear() {
 	s.TTL = 0
+	s.SlidingTTL = 0
 	s.Set = make(map[string]bool)
 }
 
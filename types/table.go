@@ -25,8 +25,9 @@ import (
 // {"code":200,"message":"request processed successfully!"}
 
 type Table struct {
-	Table map[string]any `json:"table" bson:"table" binding:"required"`
-	TTL   uint64         `json:"ttl,omitempty"`
+	Table      map[string]any `json:"table" bson:"table" binding:"required"`
+	TTL        uint64         `json:"ttl,omitempty"`
+	SlidingTTL uint64         `json:"sliding_ttl,omitempty"`
 }
 
 // 新建一个 Table
@@ -39,6 +40,7 @@ func NewTable() *Table {
 // Clear 清空 Table 和 TTL
 func (tab *Table) Clear() {
 	tab.TTL = 0
+	tab.SlidingTTL = 0
 	tab.Table = make(map[string]any)
 }
 
@@ -7,8 +7,9 @@ import (
 )
 
 type Text struct {
-	Content string `json:"content" bson:"content" binding:"required"`
-	TTL     uint64 `json:"ttl,omitempty"`
+	Content    string `json:"content" bson:"content" binding:"required"`
+	TTL        uint64 `json:"ttl,omitempty"`
+	SlidingTTL uint64 `json:"sliding_ttl,omitempty"`
 }
 
 func NewText(content string) *Text {
@@ -32,11 +33,12 @@ func (text *Text) Equals(other *Text) bool {
 }
 
 func (text *Text) Clone() *Text {
-	return &Text{Content: text.Content, TTL: text.TTL}
+	return &Text{Content: text.Content, TTL: text.TTL, SlidingTTL: text.SlidingTTL}
 }
 
 func (text *Text) Clear() {
 	text.TTL = 0
+	text.SlidingTTL = 0
 	text.Content = ""
 }
 
@@ -10,6 +10,7 @@ import (
 type ZSet struct {
 	ZSet         map[string]float64 `json:"zset" bson:"zset" binding:"required"`
 	TTL          uint64             `json:"ttl,omitempty"`
+	SlidingTTL   uint64             `json:"sliding_ttl,omitempty"`
 	sortedScores []string
 }
 
@@ -91,6 +92,7 @@ func (z *ZSet) Size() int {
 
 func (z *ZSet) Clear() {
 	z.TTL = 0
+	z.SlidingTTL = 0
 	z.ZSet = make(map[string]float64)
 	z.sortedScores = make([]string, 0)
 }
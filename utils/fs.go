@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"runtime"
 )
 
 // IsExist checked directory is exist
@@ -40,6 +41,27 @@ func FlushToDisk(fd *os.File) error {
 	return nil
 }
 
+// SyncDir flushes the directory entry of path to disk, making a preceding
+// create or rename inside of it durable. Windows cannot sync directories.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer dir.Close()
+
+	err = dir.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
+
 // BytesToGB converts a given size in bytes to gigabytes (GB).
 func BytesToGB(bytes uint64) float64 {
 	return float64(bytes) / (1024 * 1024 * 1024)
@@ -117,3 +117,15 @@ func TestBytesToGB(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncDir(t *testing.T) {
+	err := SyncDir(t.TempDir())
+	if err != nil {
+		t.Errorf("Expected directory to be synced, but got: %v", err)
+	}
+
+	err = SyncDir("/non/existent/path")
+	if err == nil {
+		t.Errorf("Expected non-existent directory to return an error")
+	}
+}
@@ -53,3 +53,101 @@ func RandomString(length int) string {
 	}
 	return string(result)
 }
+
+// GlobMatch reports whether s matches the glob pattern, the syntax follows
+// Redis style patterns: '*' matches any sequence, '?' matches a single character,
+// '[abc]' or '[a-z]' match a character class ('^' negates it) and '\' escapes.
+// Unlike path.Match, '/' has no special meaning.
+func GlobMatch(pattern, s string) bool {
+	return globMatch([]rune(pattern), []rune(s))
+}
+
+// globMatch matches iteratively, on a mismatch it only backtracks to the last
+// star seen and lets it consume one more character, so it runs in O(len(p)*len(s)).
+func globMatch(p, s []rune) bool {
+	pi, si := 0, 0
+	star, mark := -1, 0
+	for si < len(s) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '*':
+				star, mark = pi, si
+				pi++
+				continue
+			case '?':
+				pi++
+				si++
+				continue
+			case '[':
+				n, ok := matchClass(p[pi:], s[si])
+				if ok {
+					pi += n
+					si++
+					continue
+				}
+			case '\\':
+				// A trailing backslash matches itself
+				q := pi
+				if q+1 < len(p) {
+					q++
+				}
+				if p[q] == s[si] {
+					pi = q + 1
+					si++
+					continue
+				}
+			default:
+				if p[pi] == s[si] {
+					pi++
+					si++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last star consume one more character and retry after it
+		mark++
+		pi, si = star+1, mark
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// matchClass matches c against the character class at the start of p,
+// it returns the length of the class and whether c is a member.
+func matchClass(p []rune, c rune) (int, bool) {
+	i, negate, matched := 1, false, false
+	if i < len(p) && p[i] == '^' {
+		negate = true
+		i++
+	}
+
+	for first := true; i < len(p) && (first || p[i] != ']'); first = false {
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+
+	// An unterminated class is matched literally like Redis does
+	if i >= len(p) {
+		return 1, c == '['
+	}
+
+	return i + 1, matched != negate
+}
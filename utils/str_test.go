@@ -2,7 +2,9 @@ package utils
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 	"unicode/utf8"
 )
 
@@ -78,3 +80,55 @@ func TestRandomString(t *testing.T) {
 		t.Errorf("Expected length %d, but got %d", length, utf8.RuneCountInString(randomStr))
 	}
 }
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		input   string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "user:1/profile", true},
+		{"user:*", "user:1001", true},
+		{"user:*", "order:1001", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"*:profile", "user:1/x:profile", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key-[0-9]", "key-7", true},
+		{"key-[0-9]", "key-a", false},
+		{`key\*`, "key*", true},
+		{`key\*`, "key1", false},
+		{"[abc", "[abc", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"**key", "my-key", true},
+		{"*?", "", false},
+		{`key\\`, `key\`, true},
+		{`key\`, `key\`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.input, func(t *testing.T) {
+			if got := GlobMatch(tt.pattern, tt.input); got != tt.want {
+				t.Errorf("GlobMatch(%q, %q) = %v, want %v", tt.pattern, tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobMatchPathological(t *testing.T) {
+	pattern := strings.Repeat("*a", 20) + "*b"
+	input := strings.Repeat("a", 1000)
+
+	start := time.Now()
+	if GlobMatch(pattern, input) {
+		t.Errorf("GlobMatch(%q, %q) = true, want false", pattern, input)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GlobMatch took %v on a pathological pattern", elapsed)
+	}
+}
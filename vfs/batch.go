@@ -0,0 +1,237 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Batch markers are stored in the DEL byte of a segment with an empty key,
+// the value of both markers is the number of segments in the batch.
+// | BEGIN | PUT/DEL ... | COMMIT |
+const (
+	batchBegin  int8 = 2
+	batchCommit int8 = 3
+)
+
+// WriteBatch groups puts and deletes that are applied atomically by
+// LogStructuredFS.WriteBatch, after a crash either all or none of them are visible.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key string
+	seg *Segment
+}
+
+func NewWriteBatch() *WriteBatch {
+	return new(WriteBatch)
+}
+
+// Put adds a segment to be stored under key.
+func (b *WriteBatch) Put(key string, seg *Segment) {
+	b.ops = append(b.ops, batchOp{key: key, seg: seg})
+}
+
+// Delete adds a tombstone for key.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, seg: NewTombstoneSegment(key)})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// WriteBatch appends every operation of batch between a begin and a commit marker
+// with a single write, then applies the index updates in one critical section.
+// Later operations on the same key override earlier ones.
+func (lfs *LogStructuredFS) WriteBatch(batch *WriteBatch) error {
+	seq, err := lfs.writeBatch(nil, batch)
+	if err != nil {
+		return err
+	}
+	return lfs.commitWrite(seq)
+}
+
+func (lfs *LogStructuredFS) writeBatch(watches []Watch, batch *WriteBatch) (uint64, error) {
+	if uint64(batch.Len()) > uint64(^uint32(0)) {
+		return 0, errors.New("too many operations in write batch")
+	}
+
+	// The shards are locked in ascending order so that concurrent batches can not deadlock.
+	shards := make(map[uint64]struct{}, len(batch.ops))
+	for _, op := range batch.ops {
+		shards[InodeNum(op.key)%uint64(indexShard)] = struct{}{}
+	}
+	locked := make([]uint64, 0, len(shards))
+	for shard := range shards {
+		locked = append(locked, shard)
+	}
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i] < locked[j]
+	})
+
+	for _, op := range batch.ops {
+		err := encodeSegmentKey(op.seg)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode batch segment of %s: %w", op.key, err)
+		}
+	}
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// Every writer holds lfs.mu, the watched keys can not change until the batch is applied.
+	err := lfs.checkWatches(watches)
+	if err != nil {
+		return 0, err
+	}
+
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+
+	// Every segment of the batch, markers included, gets its own log sequence number.
+	bytes, begin, commit, err := lfs.serializedBatch(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	err = appendToActiveRegion(lfs.active, bytes)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, shard := range locked {
+		lfs.indexs[shard].mu.Lock()
+	}
+
+	// Replaced inodes are collected and accounted once the shards are unlocked.
+	var released []*INode
+	position := lfs.offset + uint64(begin)
+	for _, op := range batch.ops {
+		inum := InodeNum(op.key)
+		imap := lfs.indexs[inum%uint64(indexShard)]
+		if op.seg.IsTombstone() {
+			old, _ := imap.remove(inum, op.key)
+			released = append(released, old)
+		} else {
+			old := imap.insert(inum, &INode{
+				RegionID:   lfs.regionID,
+				Position:   position,
+				Length:     op.seg.Size(),
+				CreatedAt:  op.seg.CreatedAt,
+				ExpiredAt:  op.seg.ExpiredAt,
+				Key:        op.key,
+				SlidingTTL: op.seg.SlidingTTL,
+				LSN:        op.seg.LSN,
+			})
+			released = append(released, old)
+		}
+		position += uint64(op.seg.Size())
+	}
+
+	for _, shard := range locked {
+		lfs.indexs[shard].mu.Unlock()
+	}
+
+	// Markers and tombstones are never referenced by the index.
+	lfs.stats.addDead(lfs.regionID, uint64(begin+commit))
+	for _, op := range batch.ops {
+		if op.seg.IsTombstone() {
+			lfs.stats.addDead(lfs.regionID, uint64(op.seg.Size()))
+		} else {
+			lfs.stats.addLive(lfs.regionID, op.seg.Size())
+			lfs.expiry.push(InodeNum(op.key), op.key, op.seg.LSN, op.seg.ExpiredAt)
+		}
+	}
+	for _, old := range released {
+		lfs.stats.release(old)
+	}
+
+	lfs.offset += uint64(len(bytes))
+	lfs.notifyCheckpoint()
+
+	if lfs.offset >= uint64(regionThreshold) {
+		return lfs.sequence, lfs.createActiveRegion()
+	}
+
+	return lfs.sequence, nil
+}
+
+// serializedBatch assigns the log sequence numbers of a batch and returns the bytes
+// of the batch with the sizes of its begin and commit markers, lfs.mu must be held.
+func (lfs *LogStructuredFS) serializedBatch(batch *WriteBatch) ([]byte, int, int, error) {
+	count := uint32(batch.Len())
+	marker := newBatchMarker(batchBegin, count)
+	lfs.sequence++
+	marker.LSN = lfs.sequence
+	bytes, err := serializedSegment(marker)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	begin := len(bytes)
+
+	for _, op := range batch.ops {
+		lfs.sequence++
+		op.seg.LSN = lfs.sequence
+		data, err := serializedSegment(op.seg)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to serialize batch segment of %s: %w", op.key, err)
+		}
+		bytes = append(bytes, data...)
+	}
+
+	marker = newBatchMarker(batchCommit, count)
+	lfs.sequence++
+	marker.LSN = lfs.sequence
+	commit, err := serializedSegment(marker)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return append(bytes, commit...), begin, len(commit), nil
+}
+
+func newBatchMarker(marker int8, count uint32) *Segment {
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, count)
+	return &Segment{
+		Type:      Unknown,
+		Tombstone: marker,
+		CreatedAt: uint64(time.Now().UnixNano()),
+		ValueSize: uint32(len(value)),
+		Key:       []byte{},
+		Value:     value,
+	}
+}
+
+// batchCount returns the number of segments recorded in a batch marker.
+func batchCount(marker *Segment) uint32 {
+	if len(marker.Value) != 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(marker.Value)
+}
+
+// replayBatch holds the segments of a batch read during recovery until its commit marker.
+type replayBatch struct {
+	offset  uint64 // Offset of the begin marker
+	count   uint32
+	entries []replayEntry
+}
+
+type replayEntry struct {
+	offset  uint64
+	inum    uint64
+	segment *Segment
+}
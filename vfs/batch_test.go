@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	old, err := NewSegment("stale", types.NewNumber(1), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("stale", old))
+
+	table := types.NewTable()
+	table.AddItem("name", "wiredb")
+	tseg, err := NewSegment("user:1", *table, 0)
+	assert.NoError(t, err)
+
+	set := types.NewSet()
+	set.Add("user:1")
+	sseg, err := NewSegment("users", *set, 0)
+	assert.NoError(t, err)
+
+	batch := NewWriteBatch()
+	batch.Put("user:1", tseg)
+	batch.Put("users", sseg)
+	batch.Delete("stale")
+	assert.Equal(t, 3, batch.Len())
+	assert.NoError(t, fss.WriteBatch(batch))
+
+	assert.ElementsMatch(t, []string{"user:1", "users"}, fss.Keys(""))
+
+	_, seg, err := fss.FetchSegment("users")
+	assert.NoError(t, err)
+	result, err := seg.ToSet()
+	assert.NoError(t, err)
+	assert.True(t, result.Contains("user:1"))
+
+	// 没有正常关闭，重放数据文件恢复批量写入
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user:1", "users"}, recovered.Keys(""))
+
+	_, seg, err = recovered.FetchSegment("user:1")
+	assert.NoError(t, err)
+	assert.Equal(t, Table, seg.Type)
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestWriteBatchWithoutCommit(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("key-01", types.NewNumber(1), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+	valid := fss.offset
+
+	// 模拟批量写入在提交标记之前崩溃，完整的数据段也不能生效
+	begin, err := serializedSegment(newBatchMarker(batchBegin, 2))
+	assert.NoError(t, err)
+	seg, err = NewSegment("key-02", types.NewNumber(2), 0)
+	assert.NoError(t, err)
+	bytes, err := serializedSegment(seg)
+	assert.NoError(t, err)
+	_, err = fss.active.Write(append(begin, bytes...))
+	assert.NoError(t, err)
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key-01"}, recovered.Keys(""))
+	assert.Equal(t, valid, recovered.offset)
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
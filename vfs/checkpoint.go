@@ -0,0 +1,98 @@
+package vfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/wiredkv/clog"
+)
+
+// checkpoint periodically exports index snapshots while the file system keeps
+// serving requests. Restarting after an unclean shutdown then only replays the
+// segments written after the latest checkpoint instead of scanning every region.
+type checkpoint struct {
+	writes    uint64        // Writes since the last checkpoint
+	threshold uint64        // Writes that trigger a checkpoint, 0 disables the trigger
+	refreshed uint32        // Set when a read moved the expiration of a sliding key
+	trigger   chan struct{} // Signals the worker that the threshold has been reached
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// StartCheckpoint starts a background worker that exports an index snapshot every
+// interval, or earlier once writes segments have been written since the previous one.
+// A writes value of 0 only uses the interval.
+func (lfs *LogStructuredFS) StartCheckpoint(interval time.Duration, writes uint64) {
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// Return if a checkpoint worker is already running.
+	if lfs.checkpoint != nil {
+		return
+	}
+
+	cp := &checkpoint{
+		threshold: writes,
+		trigger:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	lfs.checkpoint = cp
+
+	ticker := time.NewTicker(interval)
+
+	cp.wg.Add(1)
+	go func() {
+		defer cp.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-cp.trigger:
+			case <-cp.done:
+				return
+			}
+
+			// Nothing changed since the previous checkpoint.
+			writes := atomic.SwapUint64(&cp.writes, 0)
+			refreshed := atomic.SwapUint32(&cp.refreshed, 0)
+			if writes == 0 && refreshed == 0 {
+				continue
+			}
+
+			err := lfs.ExportSnapshotIndex()
+			if err != nil {
+				clog.Warnf("failed to checkpoint index snapshot: %s", err)
+			}
+		}
+	}()
+}
+
+// StopCheckpoint stops the checkpoint worker and waits for a running export to finish.
+func (lfs *LogStructuredFS) StopCheckpoint() {
+	lfs.mu.Lock()
+	cp := lfs.checkpoint
+	lfs.checkpoint = nil
+	lfs.mu.Unlock()
+
+	if cp != nil {
+		close(cp.done)
+		cp.wg.Wait()
+	}
+}
+
+// notifyCheckpoint counts a write towards the next checkpoint, lfs.mu must be held.
+func (lfs *LogStructuredFS) notifyCheckpoint() {
+	cp := lfs.checkpoint
+	if cp == nil {
+		return
+	}
+
+	n := atomic.AddUint64(&cp.writes, 1)
+	if cp.threshold > 0 && n >= cp.threshold {
+		select {
+		case cp.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
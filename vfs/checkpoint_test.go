@@ -0,0 +1,50 @@
+package vfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/auula/wiredkv/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointByWrites(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	// 周期足够长，只有写入次数能够触发快照
+	fss.StartCheckpoint(time.Hour, 5)
+
+	for i := 0; i < 5; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+
+	snapshot := filepath.Join(opt.Path, indexFileName)
+	deadline := time.Now().Add(5 * time.Second)
+	for !utils.IsExist(snapshot) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, utils.IsExist(snapshot))
+
+	fss.StopCheckpoint()
+
+	// 不调用 CloseFS 模拟进程被强制杀死，依靠检查点恢复索引
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, recovered.KeysCount())
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
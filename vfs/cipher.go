@@ -0,0 +1,177 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Names of the built-in encryptors, as used by the encryptor.cipher setting.
+const (
+	CipherAESCBC           = "aes-cbc"
+	CipherAESGCM           = "aes-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+var (
+	AESGCMCryptor           = new(GCMCryptor)
+	ChaCha20Poly1305Cryptor = new(ChaChaCryptor)
+)
+
+// ErrDecryptFailed is returned when a value can not be decrypted, because the
+// ciphertext is malformed, fails authentication or its secret is not configured.
+var ErrDecryptFailed = errors.New("failed to decrypt data")
+
+// ciphers is the registry of encryptors by name, values are decrypted with the
+// encryptor registered with the codec ID recorded in their segment.
+var ciphers = struct {
+	mu     sync.RWMutex
+	byName map[string]Encryptor
+}{
+	byName: map[string]Encryptor{
+		CipherAESCBC:           AESCryptor,
+		CipherAESGCM:           AESGCMCryptor,
+		CipherChaCha20Poly1305: ChaCha20Poly1305Cryptor,
+	},
+}
+
+// RegisterEncryptor makes encryptor selectable by name, its codec ID must be unique.
+func RegisterEncryptor(name string, encryptor Encryptor) error {
+	if encryptor.ID() == CodecNone {
+		return errors.New("encryptor codec id must not be 0")
+	}
+
+	ciphers.mu.Lock()
+	defer ciphers.mu.Unlock()
+
+	if _, ok := ciphers.byName[name]; ok {
+		return fmt.Errorf("encryptor %s is already registered", name)
+	}
+	for other, registered := range ciphers.byName {
+		if registered.ID() == encryptor.ID() {
+			return fmt.Errorf("encryptor codec id %d is already used by %s", encryptor.ID(), other)
+		}
+	}
+
+	ciphers.byName[name] = encryptor
+	return nil
+}
+
+// LookupEncryptor returns the encryptor registered as name.
+func LookupEncryptor(name string) (Encryptor, error) {
+	ciphers.mu.RLock()
+	defer ciphers.mu.RUnlock()
+
+	encryptor, ok := ciphers.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryptor %s, supported: %v", name, encryptorNames())
+	}
+	return encryptor, nil
+}
+
+func encryptorByID(id uint8) (Encryptor, bool) {
+	ciphers.mu.RLock()
+	defer ciphers.mu.RUnlock()
+
+	for _, encryptor := range ciphers.byName {
+		if encryptor.ID() == id {
+			return encryptor, true
+		}
+	}
+	return nil, false
+}
+
+// encryptorNames must be called with ciphers.mu held.
+func encryptorNames() []string {
+	names := make([]string, 0, len(ciphers.byName))
+	for name := range ciphers.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GCMCryptor encrypts with AES-GCM, a 32 bytes secret selects AES-256.
+// | NONCE 12 | CIPHERTEXT ? | TAG 16 |
+type GCMCryptor struct{}
+
+func (c *GCMCryptor) ID() uint8 {
+	return CodecAESGCM
+}
+
+func (c *GCMCryptor) Encrypt(secret, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, plaintext)
+}
+
+func (c *GCMCryptor) Decrypt(secret, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, ciphertext)
+}
+
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ChaChaCryptor encrypts with ChaCha20-Poly1305, the secret must be 32 bytes.
+// | NONCE 12 | CIPHERTEXT ? | TAG 16 |
+type ChaChaCryptor struct{}
+
+func (c *ChaChaCryptor) ID() uint8 {
+	return CodecChaCha20Poly1305
+}
+
+func (c *ChaChaCryptor) Encrypt(secret, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(secret)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, plaintext)
+}
+
+func (c *ChaChaCryptor) Decrypt(secret, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(secret)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, ciphertext)
+}
+
+// seal encrypts plaintext with a random nonce and returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrDecryptFailed)
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ciphertext is corrupted or was tampered with", ErrDecryptFailed)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,173 @@
+package vfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Names of the built-in compressors, as used by the compressor.algorithm setting.
+const (
+	CompressorSnappy  = "snappy"
+	CompressorDeflate = "deflate"
+	CompressorGzip    = "gzip"
+)
+
+var (
+	DeflateCompressor = new(Deflate)
+	GzipCompressor    = new(Gzip)
+)
+
+// compressors is the registry of compressors by name, values are decompressed with
+// the compressor registered with the codec ID recorded in their segment.
+var compressors = struct {
+	mu     sync.RWMutex
+	byName map[string]Compressor
+}{
+	byName: map[string]Compressor{
+		CompressorSnappy:  SnappyCompressor,
+		CompressorDeflate: DeflateCompressor,
+		CompressorGzip:    GzipCompressor,
+	},
+}
+
+// RegisterCompressor makes compressor selectable by name, its codec ID must be unique.
+// Algorithms outside the standard library such as zstd or lz4 are plugged in this way.
+func RegisterCompressor(name string, compressor Compressor) error {
+	if compressor.ID() == CodecNone {
+		return errors.New("compressor codec id must not be 0")
+	}
+
+	compressors.mu.Lock()
+	defer compressors.mu.Unlock()
+
+	if _, ok := compressors.byName[name]; ok {
+		return fmt.Errorf("compressor %s is already registered", name)
+	}
+	for other, registered := range compressors.byName {
+		if registered.ID() == compressor.ID() {
+			return fmt.Errorf("compressor codec id %d is already used by %s", compressor.ID(), other)
+		}
+	}
+
+	compressors.byName[name] = compressor
+	return nil
+}
+
+// LookupCompressor returns the compressor registered as name.
+func LookupCompressor(name string) (Compressor, error) {
+	compressors.mu.RLock()
+	defer compressors.mu.RUnlock()
+
+	compressor, ok := compressors.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor %s, supported: %v", name, compressorNames())
+	}
+	return compressor, nil
+}
+
+func compressorByID(id uint8) (Compressor, bool) {
+	compressors.mu.RLock()
+	defer compressors.mu.RUnlock()
+
+	for _, compressor := range compressors.byName {
+		if compressor.ID() == id {
+			return compressor, true
+		}
+	}
+	return nil, false
+}
+
+// compressorNames must be called with compressors.mu held.
+func compressorNames() []string {
+	names := make([]string, 0, len(compressors.byName))
+	for name := range compressors.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Writers allocate large tables, they are reused between values.
+var (
+	deflateWriters = sync.Pool{
+		New: func() any {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	}
+	gzipWriters = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+)
+
+// Deflate compresses with raw DEFLATE, slower than Snappy with a better ratio.
+type Deflate struct{}
+
+func (d *Deflate) ID() uint8 {
+	return CodecDeflate
+}
+
+func (d *Deflate) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(w)
+
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Deflate) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Gzip compresses with DEFLATE in the gzip format, it adds a checksum of the
+// uncompressed data at the cost of an 18 bytes header and trailer.
+type Gzip struct{}
+
+func (g *Gzip) ID() uint8 {
+	return CodecGzip
+}
+
+func (g *Gzip) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *Gzip) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,267 @@
+package vfs
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/wiredkv/clog"
+)
+
+const (
+	// DefaultExpireInterval is how often the reaper looks for expired keys.
+	DefaultExpireInterval = time.Second
+	// DefaultExpireBatch is the number of keys the reaper removes per write batch.
+	DefaultExpireBatch = 1000
+)
+
+// expiryEntry schedules the check of a key at the time it expires. Entries are
+// never updated, an entry whose inode was replaced meanwhile is simply skipped.
+// The entry of a sliding key that was read meanwhile is scheduled again, the LSN
+// tells it apart from the entries of older versions of the key.
+type expiryEntry struct {
+	expiredAt uint64
+	lsn       uint64
+	inum      uint64
+	key       string
+}
+
+// expiryHeap is a min-heap of entries ordered by expiration time.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiredAt < h[j].expiredAt }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
+}
+
+// expiry removes expired keys actively, instead of waiting for a read to find them.
+// Its lock is only held briefly, push can be called under any other lock.
+type expiry struct {
+	mu   sync.Mutex
+	heap expiryHeap
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newExpiry() *expiry {
+	return new(expiry)
+}
+
+// push schedules key to be checked at expiredAt, keys without TTL are ignored.
+func (e *expiry) push(inum uint64, key string, lsn, expiredAt uint64) {
+	if expiredAt == 0 {
+		return
+	}
+	e.mu.Lock()
+	heap.Push(&e.heap, expiryEntry{expiredAt: expiredAt, lsn: lsn, inum: inum, key: key})
+	e.mu.Unlock()
+}
+
+// popExpired removes and returns at most limit entries that expire before now.
+func (e *expiry) popExpired(now uint64, limit int) []expiryEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var entries []expiryEntry
+	for len(entries) < limit && e.heap.Len() > 0 && e.heap[0].expiredAt <= now {
+		entries = append(entries, heap.Pop(&e.heap).(expiryEntry))
+	}
+	return entries
+}
+
+func (e *expiry) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.heap.Len()
+}
+
+// rebuildExpiry schedules every key of the recovered index that has a TTL,
+// keys that already expired are reaped on the first run.
+func (lfs *LogStructuredFS) rebuildExpiry() {
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			lfs.expiry.push(inum, inode.Key, inode.LSN, atomic.LoadUint64(&inode.ExpiredAt))
+			return true
+		})
+		imap.mu.RUnlock()
+	}
+}
+
+// StartExpireReaper starts a background worker that removes expired keys every
+// interval, at most batch keys per write batch. Zero values use DefaultExpireInterval
+// and DefaultExpireBatch. Without it expired keys are only removed when they are read.
+func (lfs *LogStructuredFS) StartExpireReaper(interval time.Duration, batch int) {
+	e := lfs.expiry
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Return if the reaper is already running.
+	if e.done != nil {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DefaultExpireInterval
+	}
+	if batch <= 0 {
+		batch = DefaultExpireBatch
+	}
+	done := make(chan struct{})
+	e.done = done
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			// Every batch is a short critical section, foreground writes interleave between them.
+			for {
+				n, err := lfs.reapExpired(batch)
+				if err != nil {
+					clog.Warnf("failed to remove expired keys: %s", err)
+					break
+				}
+				if n < batch {
+					break
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// StopExpireReaper stops the expiration worker and waits for a running batch to finish.
+func (lfs *LogStructuredFS) StopExpireReaper() {
+	e := lfs.expiry
+	e.mu.Lock()
+	done := e.done
+	e.done = nil
+	e.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		e.wg.Wait()
+	}
+}
+
+// reapExpired removes at most limit expired keys with a single write batch of
+// tombstones, so the deletion does not depend on the clock after a restart and
+// the expired segments are accounted as dead bytes. It returns the number of
+// heap entries processed.
+func (lfs *LogStructuredFS) reapExpired(limit int) (int, error) {
+	now := uint64(time.Now().UnixNano())
+	entries := lfs.expiry.popExpired(now, limit)
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if lfs.checkExpired(entry) {
+			keys = append(keys, entry.key)
+		}
+	}
+
+	for len(keys) > 0 {
+		// A key written again since it was picked is no longer expired, its watch fails.
+		batch := NewWriteBatch()
+		watches := make([]Watch, 0, len(keys))
+		for _, key := range keys {
+			batch.Delete(key)
+			watches = append(watches, Watch{Key: key, Exists: false})
+		}
+
+		seq, err := lfs.writeBatch(watches, batch)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			// A read may have moved the expiration of a sliding key meanwhile.
+			for _, entry := range entries {
+				for _, key := range conflict.Keys {
+					if entry.key == key {
+						lfs.checkExpired(entry)
+					}
+				}
+			}
+			keys = withoutKeys(keys, conflict.Keys)
+			continue
+		}
+
+		if err != nil {
+			// The keys are retried on the next run.
+			for _, entry := range entries {
+				lfs.expiry.push(entry.inum, entry.key, entry.lsn, entry.expiredAt)
+			}
+			return 0, err
+		}
+
+		return len(entries), lfs.commitWrite(seq)
+	}
+
+	return len(entries), nil
+}
+
+// checkExpired reports whether the key of entry still expires as scheduled.
+// A sliding key whose expiration was moved by reads is scheduled again.
+func (lfs *LogStructuredFS) checkExpired(entry expiryEntry) bool {
+	imap := lfs.indexs[entry.inum%uint64(indexShard)]
+	imap.mu.RLock()
+	defer imap.mu.RUnlock()
+
+	inode, ok := imap.lookup(entry.inum, entry.key)
+	if !ok {
+		return false
+	}
+
+	expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+	if expiredAt == entry.expiredAt {
+		return true
+	}
+
+	// Entries of older versions of the key are dropped, the current version has its own.
+	if inode.SlidingTTL > 0 && inode.LSN == entry.lsn && expiredAt > entry.expiredAt {
+		lfs.expiry.push(entry.inum, entry.key, entry.lsn, expiredAt)
+	}
+	return false
+}
+
+// withoutKeys returns keys without the keys in exclude.
+func withoutKeys(keys, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, key := range exclude {
+		excluded[key] = true
+	}
+
+	remain := keys[:0]
+	for _, key := range keys {
+		if !excluded[key] {
+			remain = append(remain, key)
+		}
+	}
+	return remain
+}
@@ -0,0 +1,90 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpireReaper(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	put := func(fss *LogStructuredFS, key string, expiredAt uint64) {
+		seg, err := NewSegment(key, types.NewNumber(1), 0)
+		assert.NoError(t, err)
+		seg.ExpiredAt = expiredAt
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	expiredAt := uint64(time.Now().Add(50 * time.Millisecond).UnixNano())
+	for i := 0; i < 5; i++ {
+		put(fss, fmt.Sprintf("ttl-%d", i), expiredAt)
+		put(fss, fmt.Sprintf("key-%d", i), 0)
+	}
+	// 设置过期时间之后又被覆盖的数据不会被删除
+	put(fss, "persist", expiredAt)
+	put(fss, "persist", 0)
+	assert.Equal(t, 6, fss.expiry.len())
+
+	// 索引快照中保存的数据在过期之后重新启动也会被删除
+	assert.NoError(t, fss.CloseFS())
+	time.Sleep(100 * time.Millisecond)
+
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, 11, fss.KeysCount())
+
+	// 每次最多删除 limit 个过期的数据
+	n, err := fss.reapExpired(4)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	n, err = fss.reapExpired(4)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 6, fss.KeysCount())
+
+	var indexed, live uint64
+	for _, imap := range fss.indexs {
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			indexed += uint64(inode.Length)
+			return true
+		})
+	}
+	for _, stat := range fss.RegionStats() {
+		live += stat.Live
+	}
+	assert.Equal(t, indexed, live)
+
+	_, _, err = fss.FetchSegment("persist")
+	assert.NoError(t, err)
+
+	// 删除标记已经写入磁盘，全量扫描恢复的索引中也没有过期的数据
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, fss.KeysCount())
+	fss.StartExpireReaper(10*time.Millisecond, 0)
+
+	// 后台任务主动删除过期的数据，不需要读取触发
+	put(fss, "short", uint64(time.Now().Add(20*time.Millisecond).UnixNano()))
+	assert.Equal(t, 7, fss.KeysCount())
+	assert.Eventually(t, func() bool {
+		return fss.KeysCount() == 6
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, fss.CloseFS())
+}
@@ -0,0 +1,320 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	DefaultChangeCount = 100
+	MaxChangeCount     = 10000
+)
+
+// feedMarkInterval is the number of segments between two marks of a feed region.
+const feedMarkInterval = 64
+
+// Change is an entry of the change feed, a write or a deletion of a key.
+type Change struct {
+	LSN     uint64 `json:"lsn"`
+	Key     string `json:"key"`
+	Type    string `json:"type,omitempty"`
+	Deleted bool   `json:"deleted"`
+}
+
+// changeFeed remembers what the readers of the feed have already scanned of every
+// region. Regions are append only, so each byte of a region is scanned once to build
+// its LSN range and marks, a read then starts at the mark closest to its position.
+type changeFeed struct {
+	mu      sync.Mutex
+	regions map[uint64]*feedRegion
+}
+
+// feedRegion is the scanned part of a region, marks map offsets of the region to
+// the newest LSN found before them. LSNs of garbage collection output regions are
+// not ordered, but the newest LSN before an offset only grows with the offset.
+type feedRegion struct {
+	mu      sync.Mutex
+	scanned uint64 // Offset up to which the region has been scanned
+	oldest  uint64 // Oldest LSN of the scanned segments, 0 if none
+	newest  uint64 // Newest LSN of the scanned segments
+	count   int    // Number of scanned segments
+	marks   []feedMark
+}
+
+type feedMark struct {
+	offset uint64
+	before uint64 // Newest LSN of the segments before offset
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{regions: make(map[uint64]*feedRegion)}
+}
+
+// region returns the scan state of a region, creating it on first use.
+func (feed *changeFeed) region(regionID uint64) *feedRegion {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	region, ok := feed.regions[regionID]
+	if !ok {
+		start := uint64(len(dataFileMetadata))
+		region = &feedRegion{scanned: start, marks: []feedMark{{offset: start}}}
+		feed.regions[regionID] = region
+	}
+	return region
+}
+
+// forget drops the scan state of the regions that no longer exist.
+func (feed *changeFeed) forget(regions map[uint64]*os.File) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	for regionID := range feed.regions {
+		if _, ok := regions[regionID]; !ok {
+			delete(feed.regions, regionID)
+		}
+	}
+}
+
+// extend scans the segments of the region between the scanned offset and end.
+func (region *feedRegion) extend(fd *os.File, end uint64) error {
+	region.mu.Lock()
+	defer region.mu.Unlock()
+
+	offset := region.scanned
+	header := make([]byte, SEGMENT_PADDING)
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		if errors.Is(err, errIncompleteSegment) {
+			// An append to a garbage collection output region is in progress.
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? |
+		_, err = fd.ReadAt(header, int64(offset))
+		if err != nil {
+			return err
+		}
+
+		if region.count > 0 && region.count%feedMarkInterval == 0 {
+			region.marks = append(region.marks, feedMark{offset: offset, before: region.newest})
+		}
+
+		lsn := binary.LittleEndian.Uint64(header[30:38])
+		if lsn > region.newest {
+			region.newest = lsn
+		}
+		if region.oldest == 0 || lsn < region.oldest {
+			region.oldest = lsn
+		}
+		region.count++
+
+		offset += size
+		region.scanned = offset
+	}
+
+	return nil
+}
+
+// position returns the offset to start a read after since from and the scanned offset.
+func (region *feedRegion) position(since uint64) (uint64, uint64) {
+	region.mu.Lock()
+	defer region.mu.Unlock()
+
+	// The first mark is at the start of the region with nothing before it.
+	i := sort.Search(len(region.marks), func(i int) bool {
+		return region.marks[i].before > since
+	})
+	return region.marks[i-1].offset, region.scanned
+}
+
+// bounds returns the oldest and newest LSN of the scanned segments.
+func (region *feedRegion) bounds() (uint64, uint64) {
+	region.mu.Lock()
+	defer region.mu.Unlock()
+	return region.oldest, region.newest
+}
+
+// errRegionRemoved is returned by readRegion for a region removed by garbage collection.
+var errRegionRemoved = errors.New("region removed")
+
+// ReadChanges returns at most count changes with an LSN greater than since in LSN
+// order and the LSN to pass as since to continue after them. The feed is read from
+// the regions, a reader that falls behind garbage collection misses the versions
+// and deletions that were reclaimed meanwhile, but always sees the newest version.
+func (lfs *LogStructuredFS) ReadChanges(since uint64, count int) ([]Change, uint64, error) {
+	if count <= 0 {
+		count = DefaultChangeCount
+	}
+	if count > MaxChangeCount {
+		count = MaxChangeCount
+	}
+
+	for {
+		changes, next, err := lfs.readChanges(since, count)
+		// Garbage collection removed a region during the read, its live segments
+		// were copied to a region the read did not know about, so it starts over.
+		if errors.Is(err, errRegionRemoved) {
+			continue
+		}
+		return changes, next, err
+	}
+}
+
+type feedCandidate struct {
+	regionID uint64
+	fd       *os.File
+	region   *feedRegion
+	oldest   uint64
+}
+
+func (lfs *LogStructuredFS) readChanges(since uint64, count int) ([]Change, uint64, error) {
+	// Segments are appended in LSN order under lfs.mu, everything up to the current
+	// LSN is complete in the regions and nothing newer is returned.
+	lfs.mu.RLock()
+	upto, active, offset := lfs.sequence, lfs.regionID, lfs.offset
+	regions := make(map[uint64]*os.File, len(lfs.regions))
+	for regionID, fd := range lfs.regions {
+		regions[regionID] = fd
+	}
+	lfs.mu.RUnlock()
+
+	if since >= upto {
+		return nil, since, nil
+	}
+
+	// Only the bytes appended since the last read of the feed are scanned here.
+	var candidates []feedCandidate
+	for regionID, fd := range regions {
+		region := lfs.feed.region(regionID)
+		err := lfs.readRegion(regionID, fd, func() error {
+			end := offset
+			if regionID != active {
+				finfo, err := fd.Stat()
+				if err != nil {
+					return err
+				}
+				end = uint64(finfo.Size())
+			}
+			return region.extend(fd, end)
+		})
+		if err != nil {
+			return nil, since, err
+		}
+
+		oldest, newest := region.bounds()
+		if newest > since {
+			candidates = append(candidates, feedCandidate{regionID: regionID, fd: fd, region: region, oldest: oldest})
+		}
+	}
+	lfs.feed.forget(regions)
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].oldest < candidates[j].oldest
+	})
+
+	seen := make(map[uint64]bool)
+	var changes []Change
+	for i, candidate := range candidates {
+		start, end := candidate.region.position(since)
+		err := lfs.readRegion(candidate.regionID, candidate.fd, func() error {
+			return readRegionChanges(candidate.fd, start, end, since, upto, func(change Change) {
+				// Garbage collection copies segments, a copy has the LSN of the original.
+				if !seen[change.LSN] {
+					seen[change.LSN] = true
+					changes = append(changes, change)
+				}
+			})
+		})
+		if err != nil {
+			return nil, since, err
+		}
+
+		// Only the oldest changes are returned, the rest is dropped early.
+		if len(changes) >= count {
+			sortChanges(changes)
+			changes = changes[:count]
+
+			// Regions are read by their oldest LSN, the remaining regions
+			// have nothing older than the changes collected so far.
+			if i+1 < len(candidates) && changes[count-1].LSN < candidates[i+1].oldest {
+				break
+			}
+		}
+	}
+
+	sortChanges(changes)
+	if len(changes) == count {
+		return changes, changes[count-1].LSN, nil
+	}
+
+	return changes, upto, nil
+}
+
+// readRegion calls fn with the drain lock held shared, so garbage collection can
+// not remove the region meanwhile. The lock is held for a single region only,
+// errRegionRemoved is returned if fd is no longer the region regionID.
+func (lfs *LogStructuredFS) readRegion(regionID uint64, fd *os.File, fn func() error) error {
+	lfs.drain.RLock()
+	defer lfs.drain.RUnlock()
+
+	lfs.mu.RLock()
+	current, ok := lfs.regions[regionID]
+	lfs.mu.RUnlock()
+	if !ok || current != fd {
+		return errRegionRemoved
+	}
+
+	return fn()
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].LSN < changes[j].LSN
+	})
+}
+
+// readRegionChanges calls fn for every write and deletion of a region between start
+// and end with an LSN in (since, upto], start and end are segment boundaries.
+func readRegionChanges(fd *os.File, start, end, since, upto uint64, fn func(Change)) error {
+	header := make([]byte, SEGMENT_PADDING)
+	offset := start
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		if err != nil {
+			return err
+		}
+
+		// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? |
+		_, err = fd.ReadAt(header, int64(offset))
+		if err != nil {
+			return err
+		}
+
+		// Batch markers are not changes of a key.
+		lsn := binary.LittleEndian.Uint64(header[30:38])
+		tombstone := int8(header[0])
+		if lsn > since && lsn <= upto && tombstone <= 1 {
+			key, err := readSegmentKey(fd, offset, header)
+			if err != nil {
+				return err
+			}
+
+			change := Change{LSN: lsn, Key: key, Deleted: tombstone == 1}
+			if !change.Deleted {
+				change.Type = Kind(header[1]).String()
+			}
+			fn(change)
+		}
+
+		offset += size
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadChanges(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	threshold := regionThreshold
+	regionThreshold = 512
+	defer func() { regionThreshold = threshold }()
+
+	for i := 0; i < 20; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%02d", i%10), types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(string(seg.Key), seg))
+	}
+	assert.NoError(t, fss.DeleteSegment("key-00"))
+
+	batch := NewWriteBatch()
+	seg, err := NewSegment("key-01", *types.NewText("batch"), 0)
+	assert.NoError(t, err)
+	batch.Put("key-01", seg)
+	batch.Delete("key-02")
+	assert.NoError(t, fss.WriteBatch(batch))
+
+	// 分页读取全部的修改，批量写入的标记不属于修改
+	var changes []Change
+	since := uint64(0)
+	for {
+		page, next, err := fss.ReadChanges(since, 7)
+		assert.NoError(t, err)
+		if len(page) == 0 {
+			assert.Equal(t, since, next)
+			break
+		}
+		changes = append(changes, page...)
+		since = next
+	}
+
+	assert.Len(t, changes, 23)
+	for i, change := range changes {
+		if i > 0 {
+			assert.Greater(t, change.LSN, changes[i-1].LSN)
+		}
+	}
+	assert.Equal(t, Change{LSN: 21, Key: "key-00", Deleted: true}, changes[20])
+	assert.Equal(t, Change{LSN: 23, Key: "key-01", Type: "text"}, changes[21])
+	assert.Equal(t, Change{LSN: 24, Key: "key-02", Deleted: true}, changes[22])
+
+	// 垃圾回收之后只剩下最新的版本，序列号保持不变
+	victims := fss.selectDirtyRegions(0, 0)
+	assert.NotEmpty(t, victims)
+	_, err = fss.compactRegions(victims)
+	assert.NoError(t, err)
+
+	changes, next, err := fss.ReadChanges(0, MaxChangeCount)
+	assert.NoError(t, err)
+	assert.Equal(t, fss.sequence, next)
+	latest := make(map[string]uint64)
+	for _, change := range changes {
+		latest[change.Key] = change.LSN
+	}
+	for i := 3; i < 10; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		version, _, err := fss.FetchSegment(key)
+		assert.NoError(t, err)
+		assert.Equal(t, version, latest[key])
+	}
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestReadChangesFromMark(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 5*feedMarkInterval; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%03d", i), types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(string(seg.Key), seg))
+	}
+
+	changes, next, err := fss.ReadChanges(0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 10)
+	assert.Equal(t, uint64(10), next)
+
+	// 已经扫描过的区域从最近的标记开始读取
+	region := fss.feed.region(fss.regionID)
+	start, scanned := region.position(uint64(3 * feedMarkInterval))
+	assert.Greater(t, start, uint64(len(dataFileMetadata)))
+	assert.Less(t, start, scanned)
+
+	changes, next, err = fss.ReadChanges(uint64(3*feedMarkInterval), 10)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 10)
+	assert.Equal(t, uint64(3*feedMarkInterval+1), changes[0].LSN)
+	assert.Equal(t, uint64(3*feedMarkInterval+10), next)
+
+	assert.NoError(t, fss.CloseFS())
+}
@@ -0,0 +1,158 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/auula/wiredkv/clog"
+)
+
+// FsyncPolicy decides when appended segments are flushed to disk.
+type FsyncPolicy int8
+
+const (
+	// FsyncOS leaves flushing to the operating system, acknowledged writes may be lost on power failure.
+	FsyncOS FsyncPolicy = iota
+	// FsyncAlways flushes before a write returns, concurrent writers share one fsync.
+	FsyncAlways
+	// FsyncEveryInterval flushes in the background, at most one interval of writes may be lost.
+	FsyncEveryInterval
+)
+
+// DefaultFsyncInterval is used by FsyncEveryInterval when no interval is configured.
+const DefaultFsyncInterval = time.Second
+
+var fsyncPolicyNames = map[FsyncPolicy]string{
+	FsyncOS:            "os",
+	FsyncAlways:        "always",
+	FsyncEveryInterval: "every-interval",
+}
+
+// ParseFsyncPolicy returns the fsync policy of name, an empty name is FsyncOS.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	if name == "" {
+		return FsyncOS, nil
+	}
+
+	for policy, policyName := range fsyncPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+
+	return FsyncOS, fmt.Errorf("unknown fsync policy: %s", name)
+}
+
+func (p FsyncPolicy) String() string {
+	if name, ok := fsyncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", p)
+}
+
+// groupCommit batches fsync calls, writers waiting while an fsync is running
+// are all covered by the next one instead of each issuing their own.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool   // An fsync is running
+	synced  uint64 // Sequence number of the last write known to be on disk
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newGroupCommit() *groupCommit {
+	sc := new(groupCommit)
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// Sync flushes every segment written so far to disk. Writers that need a
+// durable write regardless of the fsync policy call it after writing.
+func (lfs *LogStructuredFS) Sync() error {
+	lfs.mu.RLock()
+	seq := lfs.sequence
+	lfs.mu.RUnlock()
+	return lfs.commit(seq)
+}
+
+// commitWrite makes the write with sequence number seq durable if the fsync policy requires it.
+func (lfs *LogStructuredFS) commitWrite(seq uint64) error {
+	if lfs.fsync != FsyncAlways {
+		return nil
+	}
+	return lfs.commit(seq)
+}
+
+// commit waits until the write with sequence number seq is on disk. The first
+// waiter becomes the leader and flushes everything written up to that moment,
+// the others wait for its result.
+func (lfs *LogStructuredFS) commit(seq uint64) error {
+	sc := lfs.syncer
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for sc.synced < seq {
+		if sc.syncing {
+			sc.cond.Wait()
+			continue
+		}
+
+		sc.syncing = true
+		sc.mu.Unlock()
+
+		// Older regions are flushed when they are rotated, so only the active region is left.
+		lfs.mu.RLock()
+		active, target := lfs.active, lfs.sequence
+		lfs.mu.RUnlock()
+		err := active.Sync()
+
+		sc.mu.Lock()
+		sc.syncing = false
+		if err == nil && target > sc.synced {
+			sc.synced = target
+		}
+		sc.cond.Broadcast()
+
+		if err != nil {
+			return fmt.Errorf("failed to sync active region: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// startIntervalSync starts a background worker that flushes the written segments every interval.
+func (lfs *LogStructuredFS) startIntervalSync(interval time.Duration) {
+	sc := lfs.syncer
+	sc.done = make(chan struct{})
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := lfs.Sync()
+				if err != nil {
+					clog.Warnf("failed to sync regions in background: %s", err)
+				}
+			case <-sc.done:
+				return
+			}
+		}
+	}()
+}
+
+// stopIntervalSync stops the background flush worker if it is running.
+func (lfs *LogStructuredFS) stopIntervalSync() {
+	sc := lfs.syncer
+	if sc.done != nil {
+		close(sc.done)
+		sc.wg.Wait()
+		sc.done = nil
+	}
+}
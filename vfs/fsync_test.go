@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, name := range []string{"always", "every-interval", "os"} {
+		policy, err := ParseFsyncPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, policy.String())
+	}
+
+	policy, err := ParseFsyncPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, FsyncOS, policy)
+
+	_, err = ParseFsyncPolicy("never")
+	assert.Error(t, err)
+}
+
+func TestGroupCommitAlways(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+		Fsync:     FsyncAlways,
+	})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			seg, err := NewSegment(key, types.NewNumber(int64(i)), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, fss.PutSegment(key, seg))
+		}(i)
+	}
+	wg.Wait()
+
+	// 每个写入返回之前都已经刷盘
+	fss.syncer.mu.Lock()
+	assert.Equal(t, uint64(50), fss.syncer.synced)
+	fss.syncer.mu.Unlock()
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestGroupCommitEveryInterval(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:        conf.FSPerm,
+		Path:          t.TempDir(),
+		Threshold:     conf.Settings.Region.Threshold,
+		Fsync:         FsyncEveryInterval,
+		FsyncInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("key-01", types.NewNumber(1), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-01", seg))
+
+	synced := func() uint64 {
+		fss.syncer.mu.Lock()
+		defer fss.syncer.mu.Unlock()
+		return fss.syncer.synced
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for synced() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), synced())
+
+	assert.NoError(t, fss.CloseFS())
+}
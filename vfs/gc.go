@@ -0,0 +1,823 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/wiredkv/clog"
+	"github.com/auula/wiredkv/utils"
+)
+
+// gcFileExtension marks an output region of a running garbage collection,
+// it is only renamed to a region once every victim has been compacted.
+var gcFileExtension = ".gc"
+
+var (
+	// ErrGCRunning is returned when a garbage collection is requested while another one is running.
+	ErrGCRunning = errors.New("region garbage collection is already running")
+	// ErrInvalidRegion is returned when a region requested for compaction can not be compacted.
+	ErrInvalidRegion = errors.New("invalid region")
+)
+
+var gcStateNames = map[GC_STATE]string{
+	GC_INIT:     "stopped",
+	GC_ACTIVE:   "running",
+	GC_INACTIVE: "idle",
+}
+
+// GCStats describes the region garbage collector and its last run.
+type GCStats struct {
+	State          string      `json:"state"`
+	Interval       string      `json:"interval"`
+	RateLimit      uint64      `json:"rate_limit"` // Bytes per second, 0 is unlimited
+	Runs           uint64      `json:"runs"`
+	LastRun        time.Time   `json:"last_run"`
+	Duration       string      `json:"duration"`
+	Regions        []uint64    `json:"regions"`
+	BytesReclaimed uint64      `json:"bytes_reclaimed"`
+	TotalReclaimed uint64      `json:"total_reclaimed"`
+	Throttled      string      `json:"throttled"` // Time the last run waited for the rate limit
+	TotalThrottled string      `json:"total_throttled"`
+	Reencrypted    uint64      `json:"reencrypted"` // Values the last run encrypted again with the active secret
+	Errors         uint64      `json:"errors"`
+	LastError      string      `json:"last_error,omitempty"`
+	Progress       *GCProgress `json:"progress,omitempty"` // Set while a run is in progress
+}
+
+// GCProgress describes the garbage collection in progress.
+type GCProgress struct {
+	Started   time.Time `json:"started"`
+	Reencrypt bool      `json:"reencrypt"`
+	Regions   []uint64  `json:"regions"`   // Victims of the run, empty until they are picked
+	Compacted int       `json:"compacted"` // Victims compacted so far
+}
+
+// regionGC is the background worker started by StartRegionGC, manual and
+// background runs share it so that only one compaction runs at a time.
+type regionGC struct {
+	ctl      sync.Mutex // Serializes StartRegionGC and StopRegionGC
+	run      sync.Mutex // Held while a compaction is running
+	wg       sync.WaitGroup
+	started  sync.WaitGroup // Runs started by StartRegionGCRun
+	limiter  *rateLimiter
+	mu       sync.Mutex // Guards the fields below
+	state    GC_STATE
+	done     chan struct{}
+	interval time.Duration
+	last     gcResult
+	runs     uint64
+	lastRun  time.Time
+	duration time.Duration
+	total    uint64
+	waited   time.Duration
+	errors   uint64
+	lastErr  error
+	current  *GCProgress
+}
+
+func newRegionGC(rateLimit uint64) *regionGC {
+	return &regionGC{state: GC_INIT, limiter: newRateLimiter(rateLimit)}
+}
+
+// gcResult is the outcome of a single compaction.
+type gcResult struct {
+	regions     []uint64      // Regions that have been removed
+	reclaimed   uint64        // Disk bytes freed
+	throttled   time.Duration // Time waited for the rate limit
+	reencrypted uint64        // Values encrypted again with the active secret
+}
+
+// SetGCRateLimit changes the budget in bytes per second of the compaction
+// reads and rewrites, 0 means unlimited. A running compaction adopts it at once.
+func (lfs *LogStructuredFS) SetGCRateLimit(bytesPerSecond uint64) {
+	lfs.gc.limiter.setRate(bytesPerSecond)
+}
+
+// gcOutput is a dedicated region the live segments of the victims are copied to.
+type gcOutput struct {
+	regionID uint64
+	fd       *os.File
+	path     string
+	offset   uint64
+}
+
+// compactor copies the live segments of dirty regions to output regions
+// without blocking foreground reads and writes. Only the index swap of a
+// single key and the final removal of the victims take locks.
+type compactor struct {
+	lfs         *LogStructuredFS
+	output      *gcOutput
+	outputs     []*gcOutput
+	throttled   time.Duration
+	reencrypted uint64
+}
+
+// throttle accounts n bytes of compaction I/O against the rate limit.
+func (c *compactor) throttle(n uint64) {
+	c.throttled += c.lfs.gc.limiter.wait(n)
+}
+
+// RunRegionGC compacts the given regions right away, or the regions that meet the
+// garbage thresholds if none are given. ErrGCRunning is returned if a garbage
+// collection is already running. The returned stats describe the finished run.
+func (lfs *LogStructuredFS) RunRegionGC(regionIds ...uint64) (GCStats, error) {
+	err := lfs.acquireRegionGC(regionIds)
+	if err != nil {
+		return lfs.GCStats(), err
+	}
+	defer lfs.gc.run.Unlock()
+
+	err = lfs.runRegionGC(false, regionIds)
+	return lfs.GCStats(), err
+}
+
+// ReencryptRegions compacts the sealed regions holding values that are not encrypted
+// with the current encryptor and the active secret of its keyring, the relocated
+// values are encrypted again. Values in the active region are only rewritten once
+// it is sealed. ErrGCRunning is returned if a garbage collection is already running.
+func (lfs *LogStructuredFS) ReencryptRegions() (GCStats, error) {
+	err := lfs.acquireRegionGC(nil)
+	if err != nil {
+		return lfs.GCStats(), err
+	}
+	defer lfs.gc.run.Unlock()
+
+	err = lfs.runRegionGC(true, nil)
+	return lfs.GCStats(), err
+}
+
+// StartRegionGCRun is RunRegionGC, or ReencryptRegions if reencrypt is set, in the
+// background. It returns once the run is started, ErrGCRunning and ErrInvalidRegion
+// are reported right away, the progress and the result of the run by GCStats.
+func (lfs *LogStructuredFS) StartRegionGCRun(reencrypt bool, regionIds ...uint64) error {
+	err := lfs.acquireRegionGC(regionIds)
+	if err != nil {
+		return err
+	}
+
+	gc := lfs.gc
+	gc.mu.Lock()
+	gc.state = GC_ACTIVE
+	gc.current = &GCProgress{Started: time.Now(), Reencrypt: reencrypt}
+	gc.mu.Unlock()
+
+	gc.started.Add(1)
+	go func() {
+		defer gc.started.Done()
+		defer gc.run.Unlock()
+
+		err := lfs.runRegionGC(reencrypt, regionIds)
+		if err != nil {
+			clog.Warnf("failed to run region garbage collection: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// acquireRegionGC takes gc.run for a new run of the given regions, the caller releases it.
+func (lfs *LogStructuredFS) acquireRegionGC(regionIds []uint64) error {
+	gc := lfs.gc
+	if !gc.run.TryLock() {
+		return ErrGCRunning
+	}
+
+	if len(regionIds) > 0 {
+		err := lfs.checkVictims(regionIds)
+		if err != nil {
+			gc.run.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// staleRegions returns the sealed regions with a live value encoded by a stale codec,
+// gc.run must be held.
+func (lfs *LogStructuredFS) staleRegions() ([]uint64, error) {
+	lfs.mu.RLock()
+	regionIds := make([]uint64, 0, len(lfs.regions))
+	for regionID := range lfs.regions {
+		if regionID != lfs.regionID {
+			regionIds = append(regionIds, regionID)
+		}
+	}
+	lfs.mu.RUnlock()
+
+	sort.Slice(regionIds, func(i, j int) bool {
+		return regionIds[i] < regionIds[j]
+	})
+
+	var victims []uint64
+	for _, regionID := range regionIds {
+		stale, err := lfs.isStaleRegion(regionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan region %d: %w", regionID, err)
+		}
+		if stale {
+			victims = append(victims, regionID)
+		}
+	}
+
+	return victims, nil
+}
+
+// isStaleRegion reads the segment headers of a region until it finds a live value
+// encoded by a stale codec. It is called with gc.run held, only garbage collection
+// removes regions, so the region is read without the drain lock and does not make
+// a waiting removal block the foreground reads.
+func (lfs *LogStructuredFS) isStaleRegion(regionID uint64) (bool, error) {
+	lfs.mu.RLock()
+	fd, ok := lfs.regions[regionID]
+	lfs.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	end := uint64(finfo.Size())
+	offset := uint64(len(dataFileMetadata))
+	header := make([]byte, SEGMENT_PADDING)
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		if err != nil {
+			return false, fmt.Errorf("failed to read segment at offset %d: %w", offset, err)
+		}
+
+		_, err = fd.ReadAt(header, int64(offset))
+		if err != nil {
+			return false, fmt.Errorf("failed to read segment at offset %d: %w", offset, err)
+		}
+
+		// Batch markers are dropped by the compaction anyway.
+		if header[0] <= 1 && transformer.stale(headerCodec(header), header[0] == 1) {
+			return true, nil
+		}
+		offset += size
+	}
+
+	return false, nil
+}
+
+// runRegionGC picks the victims of a run and compacts them, gc.run must be held.
+func (lfs *LogStructuredFS) runRegionGC(reencrypt bool, regionIds []uint64) error {
+	gc := lfs.gc
+	start := time.Now()
+	gc.mu.Lock()
+	gc.state = GC_ACTIVE
+	if gc.current == nil {
+		gc.current = &GCProgress{Started: start, Reencrypt: reencrypt}
+	}
+	gc.mu.Unlock()
+
+	victims, err := lfs.pickVictims(reencrypt, regionIds)
+	if err != nil || (reencrypt && len(victims) == 0) {
+		// Nothing was compacted, this does not count as a run.
+		gc.mu.Lock()
+		gc.current = nil
+		gc.state = gc.idleState()
+		gc.mu.Unlock()
+		return err
+	}
+
+	gc.mu.Lock()
+	gc.current.Regions = victims
+	gc.mu.Unlock()
+
+	result, err := lfs.compactRegions(victims)
+
+	gc.mu.Lock()
+	gc.runs++
+	gc.lastRun, gc.duration = start, time.Since(start)
+	gc.last, gc.lastErr = result, err
+	gc.total += result.reclaimed
+	gc.waited += result.throttled
+	if err != nil {
+		gc.errors++
+	}
+	gc.current = nil
+	gc.state = gc.idleState()
+	gc.mu.Unlock()
+
+	return err
+}
+
+// idleState is the state once a run is over, the worker may have been
+// stopped or started while compacting. It must be called with mu held.
+func (gc *regionGC) idleState() GC_STATE {
+	if gc.done != nil {
+		return GC_INACTIVE
+	}
+	return GC_INIT
+}
+
+// pickVictims returns the regions a run compacts, the requested regions, the regions
+// with values of a stale codec or else the regions that meet the garbage thresholds.
+func (lfs *LogStructuredFS) pickVictims(reencrypt bool, regionIds []uint64) ([]uint64, error) {
+	if reencrypt {
+		victims, err := lfs.staleRegions()
+		if err == nil && len(victims) == 0 {
+			clog.Debug("no sealed region holds values of a retired secret")
+		}
+		return victims, err
+	}
+
+	if len(regionIds) > 0 {
+		return regionIds, nil
+	}
+
+	victims := lfs.selectDirtyRegions(lfs.gcRatio, lfs.gcMinGarbage)
+	if len(victims) == 0 {
+		clog.Debug("no dirty region meets the garbage collection thresholds")
+	}
+	return victims, nil
+}
+
+// checkVictims verifies that every requested region exists and is sealed.
+func (lfs *LogStructuredFS) checkVictims(regionIds []uint64) error {
+	lfs.mu.RLock()
+	defer lfs.mu.RUnlock()
+
+	seen := make(map[uint64]bool, len(regionIds))
+	for _, regionID := range regionIds {
+		if _, ok := lfs.regions[regionID]; !ok {
+			return fmt.Errorf("%w: region %d does not exist", ErrInvalidRegion, regionID)
+		}
+		if regionID == lfs.regionID {
+			return fmt.Errorf("%w: region %d is the active region", ErrInvalidRegion, regionID)
+		}
+		if seen[regionID] {
+			return fmt.Errorf("%w: region %d is duplicated", ErrInvalidRegion, regionID)
+		}
+		seen[regionID] = true
+	}
+
+	return nil
+}
+
+// GCStats returns the state of the garbage collector and the result of its last run.
+func (lfs *LogStructuredFS) GCStats() GCStats {
+	gc := lfs.gc
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	stats := GCStats{
+		State:          gcStateNames[gc.state],
+		RateLimit:      gc.limiter.getRate(),
+		Runs:           gc.runs,
+		LastRun:        gc.lastRun,
+		Regions:        append([]uint64{}, gc.last.regions...),
+		BytesReclaimed: gc.last.reclaimed,
+		TotalReclaimed: gc.total,
+		Throttled:      gc.last.throttled.String(),
+		TotalThrottled: gc.waited.String(),
+		Reencrypted:    gc.last.reencrypted,
+		Errors:         gc.errors,
+	}
+	if gc.interval > 0 {
+		stats.Interval = gc.interval.String()
+	}
+	if gc.runs > 0 {
+		stats.Duration = gc.duration.String()
+	}
+	if gc.lastErr != nil {
+		stats.LastError = gc.lastErr.Error()
+	}
+	if gc.current != nil {
+		progress := *gc.current
+		progress.Regions = append([]uint64{}, gc.current.Regions...)
+		stats.Progress = &progress
+	}
+
+	return stats
+}
+
+// compactRegions compacts the victims into new regions and removes them. If a
+// victim fails, the regions compacted before it are still published and removed.
+func (lfs *LogStructuredFS) compactRegions(victims []uint64) (gcResult, error) {
+	c := &compactor{lfs: lfs}
+
+	var compacted []uint64
+	var cerr error
+	for _, regionID := range victims {
+		err := c.compactRegion(regionID)
+		if err != nil {
+			cerr = fmt.Errorf("failed to compact region %d: %w", regionID, err)
+			break
+		}
+		compacted = append(compacted, regionID)
+
+		lfs.gc.mu.Lock()
+		if lfs.gc.current != nil {
+			lfs.gc.current.Compacted++
+		}
+		lfs.gc.mu.Unlock()
+	}
+
+	// The victims are only removed once their live segments are durable under a region name.
+	err := c.finish()
+	if err != nil {
+		return gcResult{throttled: c.throttled, reencrypted: c.reencrypted}, errors.Join(cerr, fmt.Errorf("failed to publish compacted regions: %w", err))
+	}
+
+	var written uint64
+	for _, out := range c.outputs {
+		written += out.offset
+	}
+
+	freed, err := lfs.removeRegions(compacted)
+	result := gcResult{regions: compacted, throttled: c.throttled, reencrypted: c.reencrypted}
+	if freed > written {
+		result.reclaimed = freed - written
+	}
+	if err != nil {
+		return result, errors.Join(cerr, err)
+	}
+
+	return result, cerr
+}
+
+// compactRegion walks the segments of a region and relocates those still referenced by the index.
+func (c *compactor) compactRegion(regionID uint64) error {
+	lfs := c.lfs
+
+	lfs.mu.RLock()
+	fd, ok := lfs.regions[regionID]
+	active := lfs.regionID
+	lfs.mu.RUnlock()
+	if !ok || regionID == active {
+		return nil
+	}
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	// A deletion may only be dropped if no other region can hold an older version
+	// of the key, otherwise a full replay would bring that version back.
+	oldest := lfs.oldestGarbage(regionID)
+
+	end := uint64(finfo.Size())
+	offset := uint64(len(dataFileMetadata))
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		if err != nil {
+			return fmt.Errorf("failed to read segment at offset %d: %w", offset, err)
+		}
+
+		// The raw bytes are copied, the value stays encoded as it was written.
+		raw := make([]byte, size)
+		_, err = fd.ReadAt(raw, int64(offset))
+		if err != nil {
+			return fmt.Errorf("failed to read segment at offset %d: %w", offset, err)
+		}
+		c.throttle(size)
+
+		checksum := binary.LittleEndian.Uint32(raw[size-4:])
+		if checksum != crc32.ChecksumIEEE(raw[:size-4]) {
+			return fmt.Errorf("failed to crc32 checksum mismatch at offset %d: %d", offset, checksum)
+		}
+
+		// Batch markers are dropped, the batches of a sealed region are all committed.
+		// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
+		klen := binary.LittleEndian.Uint32(raw[18:22])
+		key, err := transformer.DecodeKey(headerCodec(raw), raw[SEGMENT_PADDING:SEGMENT_PADDING+uint64(klen)])
+		if err != nil {
+			return fmt.Errorf("failed to decrypt segment key at offset %d: %w", offset, err)
+		}
+		lsn := binary.LittleEndian.Uint64(raw[30:38])
+		switch int8(raw[0]) {
+		case 0:
+			err = c.relocate(regionID, offset, string(key), raw, oldest)
+		case 1:
+			if c.keepDeletion(string(key), lsn, oldest) {
+				err = c.retain(raw)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		offset += size
+	}
+
+	return nil
+}
+
+// relocate copies the segment at offset to an output region if its inode still
+// points to it, then moves the inode unless a writer replaced it meanwhile.
+func (c *compactor) relocate(regionID, offset uint64, key string, raw []byte, oldest uint64) error {
+	lfs := c.lfs
+	inum := InodeNum(key)
+	imap := lfs.indexs[inum%uint64(indexShard)]
+
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum, key)
+	imap.mu.RUnlock()
+	if !ok {
+		// A read or a previous compaction drops an expired key from the index without
+		// writing a tombstone, its expired segment stays the deletion for recovery.
+		expiredAt := binary.LittleEndian.Uint64(raw[2:10])
+		if expiredAt != 0 && expiredAt <= uint64(time.Now().UnixNano()) &&
+			c.keepDeletion(key, binary.LittleEndian.Uint64(raw[30:38]), oldest) {
+			return c.retain(raw)
+		}
+		return nil
+	}
+	if atomic.LoadUint64(&inode.RegionID) != regionID || atomic.LoadUint64(&inode.Position) != offset {
+		return nil
+	}
+
+	// The region is about to be removed, an expired inode would point nowhere.
+	// The expired segment is a deletion for recovery, it is kept like a tombstone
+	// and kept again by later compactions as long as older versions may exist.
+	expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+	if expiredAt != 0 && expiredAt <= uint64(time.Now().UnixNano()) {
+		imap.mu.Lock()
+		if current, ok := imap.lookup(inum, key); ok && current == inode {
+			imap.remove(inum, key)
+			lfs.stats.release(inode)
+		}
+		imap.mu.Unlock()
+
+		if c.keepDeletion(key, inode.LSN, oldest) {
+			return c.retain(raw)
+		}
+		return nil
+	}
+
+	// Values of a retired secret or cipher are encrypted again on the way.
+	raw, reencrypted, err := reencode(raw)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt segment at offset %d: %w", offset, err)
+	}
+
+	out, err := c.outputRegion()
+	if err != nil {
+		return err
+	}
+
+	c.throttle(uint64(len(raw)))
+	err = appendToActiveRegion(out.fd, raw)
+	if err != nil {
+		return err
+	}
+	if reencrypted {
+		c.reencrypted++
+	}
+	position := out.offset
+	out.offset += uint64(len(raw))
+
+	imap.mu.Lock()
+	if current, ok := imap.lookup(inum, key); ok && current == inode {
+		imap.insert(inum, &INode{
+			RegionID:   out.regionID,
+			Position:   position,
+			Length:     uint32(len(raw)),
+			CreatedAt:  inode.CreatedAt,
+			ExpiredAt:  atomic.LoadUint64(&inode.ExpiredAt),
+			Key:        key,
+			SlidingTTL: inode.SlidingTTL,
+			LSN:        atomic.LoadUint64(&inode.LSN),
+		})
+		lfs.stats.addLive(out.regionID, uint32(len(raw)))
+	} else {
+		lfs.stats.addDead(out.regionID, uint64(len(raw)))
+		lfs.stats.observe(out.regionID, inode.LSN)
+	}
+	imap.mu.Unlock()
+
+	if out.offset >= uint64(regionThreshold) {
+		c.output = nil
+	}
+
+	return nil
+}
+
+// reencode encodes the key and value of a raw segment again if its codec is stale,
+// the header keeps everything but the key size, the value size and the codec.
+func reencode(raw []byte) ([]byte, bool, error) {
+	codec := headerCodec(raw)
+	tombstone := raw[0] != 0
+	if !transformer.stale(codec, tombstone) {
+		return raw, false, nil
+	}
+
+	klen := uint64(binary.LittleEndian.Uint32(raw[18:22]))
+	vlen := uint64(binary.LittleEndian.Uint32(raw[22:26]))
+	key, err := transformer.DecodeKey(codec, raw[SEGMENT_PADDING:SEGMENT_PADDING+klen])
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, encoded := raw[SEGMENT_PADDING+klen:SEGMENT_PADDING+klen+vlen], Codec{}
+	if !tombstone {
+		plain, err := transformer.Decode(codec, value)
+		if err != nil {
+			return nil, false, err
+		}
+		value, encoded, err = transformer.Encode(plain)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	key, encoded, err = transformer.EncodeKey(key, encoded)
+	if err != nil {
+		return nil, false, err
+	}
+
+	buf := make([]byte, 0, SEGMENT_PADDING+uint64(len(key)+len(value))+4)
+	buf = append(buf, raw[:SEGMENT_PADDING]...)
+	binary.LittleEndian.PutUint32(buf[18:22], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[22:26], uint32(len(value)))
+	buf[38], buf[39] = encoded.Compressor, encoded.Encryptor
+	binary.LittleEndian.PutUint32(buf[40:44], encoded.KeyID)
+	buf[44] = encoded.Flags
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	return buf, true, nil
+}
+
+// keepDeletion reports whether a deletion of key with log sequence number lsn is
+// still needed. It is not once the key has a newer version, which wins the replay
+// anyway, or once the garbage of every other region was written after it.
+// Older versions of a deleted key are always garbage.
+func (c *compactor) keepDeletion(key string, lsn, oldest uint64) bool {
+	inum := InodeNum(key)
+	imap := c.lfs.indexs[inum%uint64(indexShard)]
+
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum, key)
+	imap.mu.RUnlock()
+	if ok && atomic.LoadUint64(&inode.LSN) > lsn {
+		return false
+	}
+
+	return oldest <= lsn
+}
+
+// retain copies a deletion or an expired segment to an output region, it is never
+// referenced by the index.
+func (c *compactor) retain(raw []byte) error {
+	// The key of a deletion is encrypted again like the key of a value.
+	raw, reencrypted, err := reencode(raw)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt deletion: %w", err)
+	}
+
+	out, err := c.outputRegion()
+	if err != nil {
+		return err
+	}
+
+	c.throttle(uint64(len(raw)))
+	err = appendToActiveRegion(out.fd, raw)
+	if err != nil {
+		return err
+	}
+	if reencrypted {
+		c.reencrypted++
+	}
+
+	out.offset += uint64(len(raw))
+	c.lfs.stats.addDead(out.regionID, uint64(len(raw)))
+
+	if out.offset >= uint64(regionThreshold) {
+		c.output = nil
+	}
+
+	return nil
+}
+
+// outputRegion returns the output region being filled, a new one is allocated
+// when there is none. Output regions are readable as soon as they are registered,
+// but keep the gc extension until they are published.
+func (c *compactor) outputRegion() (*gcOutput, error) {
+	if c.output != nil {
+		return c.output, nil
+	}
+
+	lfs := c.lfs
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	regionID := lfs.lastRegionID + 1
+	fileName, err := generateFileName(regionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new gc region name: %w", err)
+	}
+
+	path := filepath.Join(lfs.directory, fileName+gcFileExtension)
+	fd, err := createRegionFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gc region: %w", err)
+	}
+
+	lfs.lastRegionID = regionID
+	lfs.regions[regionID] = fd
+	lfs.stats.track(regionID)
+
+	c.output = &gcOutput{
+		regionID: regionID,
+		fd:       fd,
+		path:     path,
+		offset:   uint64(len(dataFileMetadata)),
+	}
+	c.outputs = append(c.outputs, c.output)
+
+	return c.output, nil
+}
+
+// finish flushes the output regions and renames them to regular regions.
+func (c *compactor) finish() error {
+	if len(c.outputs) == 0 {
+		return nil
+	}
+
+	lfs := c.lfs
+	last := c.outputs[len(c.outputs)-1].regionID
+
+	// The active region is always the newest region, recovery appends to the highest region id.
+	lfs.mu.Lock()
+	var err error
+	if lfs.regionID < last {
+		err = lfs.createActiveRegion()
+	}
+	lfs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, out := range c.outputs {
+		err := out.fd.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync gc region %d: %w", out.regionID, err)
+		}
+
+		err = os.Rename(out.path, filepath.Join(lfs.directory, formatDataFileName(out.regionID)))
+		if err != nil {
+			return fmt.Errorf("failed to rename gc region %d: %w", out.regionID, err)
+		}
+	}
+
+	return utils.SyncDir(lfs.directory)
+}
+
+// removeRegions unregisters the regions, waits for the readers still using
+// them and deletes their files. It returns the size of the deleted files.
+func (lfs *LogStructuredFS) removeRegions(regionIds []uint64) (uint64, error) {
+	if len(regionIds) == 0 {
+		return 0, nil
+	}
+
+	lfs.drain.Lock()
+	lfs.mu.Lock()
+	removed := make(map[uint64]*os.File, len(regionIds))
+	for _, regionID := range regionIds {
+		if fd, ok := lfs.regions[regionID]; ok {
+			removed[regionID] = fd
+			delete(lfs.regions, regionID)
+		}
+	}
+	lfs.mu.Unlock()
+	lfs.drain.Unlock()
+
+	var freed uint64
+	for regionID, fd := range removed {
+		lfs.stats.drop(regionID)
+
+		finfo, err := fd.Stat()
+		if err == nil {
+			freed += uint64(finfo.Size())
+		}
+
+		err = fd.Close()
+		if err != nil {
+			return freed, fmt.Errorf("failed to close region: %w", err)
+		}
+
+		err = os.Remove(filepath.Join(lfs.directory, formatDataFileName(regionID)))
+		if err != nil {
+			return freed, fmt.Errorf("failed to remove region: %w", err)
+		}
+	}
+
+	return freed, utils.SyncDir(lfs.directory)
+}
@@ -0,0 +1,408 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnlineRegionGC(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	threshold := regionThreshold
+	regionThreshold = 512
+	defer func() { regionThreshold = threshold }()
+
+	put := func(fss *LogStructuredFS, key string, n int64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 40; i++ {
+			put(fss, fmt.Sprintf("key-%02d", i), int64(round*100+i))
+		}
+	}
+
+	victims := fss.selectDirtyRegions(DefaultGarbageRatio, 0)
+	assert.NotEmpty(t, victims)
+
+	// 垃圾回收期间前台的读写不会被阻塞，也不会读到旧数据
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			put(fss, fmt.Sprintf("key-%02d", i), int64(1000+i))
+		}
+		for i := 20; i < 25; i++ {
+			assert.NoError(t, fss.DeleteSegment(fmt.Sprintf("key-%02d", i)))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 25; i < 40; i++ {
+			_, seg, err := fss.FetchSegment(fmt.Sprintf("key-%02d", i))
+			assert.NoError(t, err)
+			number, err := seg.ToNumber()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(200+i), number.Value)
+		}
+	}()
+
+	_, err = fss.compactRegions(victims)
+	assert.NoError(t, err)
+	wg.Wait()
+
+	for _, regionID := range victims {
+		_, ok := fss.regions[regionID]
+		assert.False(t, ok)
+	}
+
+	// 活跃数据文件始终是编号最大的数据文件
+	for regionID := range fss.regions {
+		assert.LessOrEqual(t, regionID, fss.regionID)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(opt.Path, "*"+gcFileExtension))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+
+	check := func(fss *LogStructuredFS) {
+		assert.Equal(t, 35, fss.KeysCount())
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key-%02d", i)
+			_, seg, err := fss.FetchSegment(key)
+			if i >= 20 && i < 25 {
+				assert.Error(t, err)
+				continue
+			}
+			assert.NoError(t, err)
+			number, err := seg.ToNumber()
+			assert.NoError(t, err)
+			if i < 20 {
+				assert.Equal(t, int64(1000+i), number.Value)
+			} else {
+				assert.Equal(t, int64(200+i), number.Value)
+			}
+		}
+	}
+	check(fss)
+
+	assert.NoError(t, fss.CloseFS())
+
+	// 没有完成的垃圾回收留下的输出文件在启动时被清理，全量扫描恢复的索引依然正确
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	leftover := filepath.Join(opt.Path, formatDataFileName(fss.lastRegionID+1)+gcFileExtension)
+	assert.NoError(t, os.WriteFile(leftover, dataFileMetadata, conf.FSPerm))
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	regionThreshold = 512
+	assert.NoFileExists(t, leftover)
+	check(recovered)
+	assert.NoError(t, recovered.CloseFS())
+}
+
+func TestCompactionKeepsTombstones(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	put := func(fss *LogStructuredFS, key string, n int64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	rotate := func(fss *LogStructuredFS) uint64 {
+		fss.mu.Lock()
+		defer fss.mu.Unlock()
+		regionID := fss.regionID
+		assert.NoError(t, fss.createActiveRegion())
+		return regionID
+	}
+
+	// 返回保存 key 删除标记的数据文件
+	tombstoneRegion := func(fss *LogStructuredFS, key string) (uint64, bool) {
+		for regionID, fd := range fss.regions {
+			finfo, err := fd.Stat()
+			assert.NoError(t, err)
+			offset := uint64(len(dataFileMetadata))
+			for offset < uint64(finfo.Size()) {
+				_, seg, err := readSegment(fd, offset, SEGMENT_PADDING)
+				assert.NoError(t, err)
+				if seg.IsTombstone() && string(seg.Key) == key {
+					return regionID, true
+				}
+				offset += uint64(seg.Size())
+			}
+		}
+		return 0, false
+	}
+
+	put(fss, "gone", 1)
+	for i := 0; i < 10; i++ {
+		put(fss, fmt.Sprintf("keep-%d", i), int64(i))
+	}
+	older := rotate(fss)
+
+	assert.NoError(t, fss.DeleteSegment("gone"))
+	for i := 0; i < 10; i++ {
+		put(fss, fmt.Sprintf("tmp-%d", i), int64(i))
+	}
+	deleted := rotate(fss)
+	for i := 0; i < 10; i++ {
+		put(fss, fmt.Sprintf("tmp-%d", i), int64(i*10))
+	}
+
+	// 旧的数据文件中还有 gone 的旧版本，删除标记必须保留下来
+	_, err = fss.compactRegions([]uint64{deleted})
+	assert.NoError(t, err)
+	regionID, ok := tombstoneRegion(fss, "gone")
+	assert.True(t, ok)
+	assert.NotEqual(t, deleted, regionID)
+
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	_, _, err = recovered.FetchSegment("gone")
+	assert.Error(t, err)
+	assert.Equal(t, 20, recovered.KeysCount())
+
+	// 旧版本被回收之后，删除标记也可以安全地清理掉
+	_, err = recovered.compactRegions([]uint64{older})
+	assert.NoError(t, err)
+	regionID, ok = tombstoneRegion(recovered, "gone")
+	assert.True(t, ok)
+	_, err = recovered.compactRegions([]uint64{regionID})
+	assert.NoError(t, err)
+	_, ok = tombstoneRegion(recovered, "gone")
+	assert.False(t, ok)
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+
+	recovered, err = OpenFS(opt)
+	assert.NoError(t, err)
+	_, _, err = recovered.FetchSegment("gone")
+	assert.Error(t, err)
+	assert.Equal(t, 20, recovered.KeysCount())
+	assert.NoError(t, recovered.CloseFS())
+}
+
+// 读取时过期的 key 没有写入删除标记，压缩之后全量恢复也不能出现旧的版本
+func TestCompactionKeepsExpiredSegments(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	rotate := func() uint64 {
+		fss.mu.Lock()
+		defer fss.mu.Unlock()
+		sealed := fss.regionID
+		assert.NoError(t, fss.createActiveRegion())
+		return sealed
+	}
+
+	seg, err := NewSegment("k", types.NewNumber(1), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("k", seg))
+	rotate()
+
+	seg, err = NewSegment("k", types.NewNumber(2), 0)
+	assert.NoError(t, err)
+	seg.ExpiredAt = uint64(time.Now().Add(50 * time.Millisecond).UnixNano())
+	assert.NoError(t, fss.PutSegment("k", seg))
+	expired := rotate()
+
+	time.Sleep(100 * time.Millisecond)
+	_, _, err = fss.FetchSegment("k")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// 过期的数据段被保留下来，再次压缩保留它的数据文件也不会丢掉
+	_, err = fss.RunRegionGC(expired)
+	assert.NoError(t, err)
+	_, err = fss.RunRegionGC(rotate())
+	assert.NoError(t, err)
+
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	_, _, err = fss.FetchSegment("k")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestRegionGCControl(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, GC_INIT, fss.GCState())
+	assert.Equal(t, "stopped", fss.GCStats().State)
+
+	fss.StartRegionGC(time.Hour)
+	assert.Equal(t, GC_INACTIVE, fss.GCState())
+	assert.Equal(t, "idle", fss.GCStats().State)
+	assert.Equal(t, "1h0m0s", fss.GCStats().Interval)
+
+	// 活跃的数据文件和不存在的数据文件不能被压缩
+	_, err = fss.RunRegionGC(fss.regionID)
+	assert.ErrorIs(t, err, ErrInvalidRegion)
+	_, err = fss.RunRegionGC(fss.regionID + 100)
+	assert.ErrorIs(t, err, ErrInvalidRegion)
+
+	stats, err := fss.RunRegionGC()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Runs)
+	assert.Empty(t, stats.Regions)
+	assert.Equal(t, "idle", stats.State)
+
+	// 同一时间只能运行一个垃圾回收
+	fss.gc.run.Lock()
+	_, err = fss.RunRegionGC()
+	assert.ErrorIs(t, err, ErrGCRunning)
+	assert.ErrorIs(t, fss.StartRegionGCRun(false), ErrGCRunning)
+	fss.gc.run.Unlock()
+
+	// 后台运行的垃圾回收立即返回，通过状态查看进度和结果
+	assert.ErrorIs(t, fss.StartRegionGCRun(false, fss.regionID), ErrInvalidRegion)
+	assert.NoError(t, fss.StartRegionGCRun(false))
+	fss.gc.started.Wait()
+	stats = fss.GCStats()
+	assert.Equal(t, uint64(2), stats.Runs)
+	assert.Nil(t, stats.Progress)
+	assert.Equal(t, "idle", stats.State)
+
+	fss.StopRegionGC()
+	assert.Equal(t, GC_INIT, fss.GCState())
+
+	fss.SetGCRateLimit(4 * MB)
+	assert.Equal(t, uint64(4*MB), fss.GCStats().RateLimit)
+
+	// 暂停之后可以重新启动
+	fss.StartRegionGC(time.Minute)
+	assert.Equal(t, GC_INACTIVE, fss.GCState())
+	assert.NoError(t, fss.CloseFS())
+	assert.Equal(t, GC_INIT, fss.GCState())
+}
+
+// 轮换密钥之后旧数据仍然可以读取，压缩时使用新的密钥重新加密
+func TestReencryptRegions(t *testing.T) {
+	defer func() {
+		transformer = NewTransformer()
+	}()
+
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	oldSecret := []byte("1234567890123456")
+	newSecret := []byte("12345678901234567890123456789012")
+	assert.NoError(t, fss.SetEncryptor(AESCryptor, oldSecret))
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		seg, err := NewSegment(key, *types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	keyring, err := NewKeyring(newSecret, oldSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyID(newSecret), keyring.ActiveID())
+	assert.ElementsMatch(t, []uint32{KeyID(oldSecret), KeyID(newSecret)}, keyring.IDs())
+	assert.NoError(t, fss.SetKeyring(AESGCMCryptor, keyring))
+
+	// 旧密钥加密的数据使用轮换下来的密钥解密
+	_, seg, err := fss.FetchSegment("key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, Codec{Encryptor: CodecAESCBC, KeyID: KeyID(oldSecret)}, seg.Codec)
+
+	// 活跃的数据文件封存之后才会被重新加密
+	stats, err := fss.ReencryptRegions()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.Runs)
+
+	fss.mu.Lock()
+	sealed := fss.regionID
+	assert.NoError(t, fss.createActiveRegion())
+	fss.mu.Unlock()
+
+	stats, err = fss.ReencryptRegions()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{sealed}, stats.Regions)
+	assert.Equal(t, uint64(10), stats.Reencrypted)
+
+	// 只配置新的密钥也能读取所有的数据
+	assert.NoError(t, fss.SetEncryptor(AESGCMCryptor, newSecret))
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, seg, err := fss.FetchSegment(key)
+		assert.NoError(t, err)
+		assert.Equal(t, Codec{Encryptor: CodecAESGCM, KeyID: KeyID(newSecret)}, seg.Codec)
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, key, text.Content)
+	}
+
+	// 已经全部使用新的密钥，不需要再次压缩
+	stats, err = fss.ReencryptRegions()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Runs)
+
+	// 重新打开之后全量扫描恢复的索引指向重新加密的数据
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	_, seg, err = fss.FetchSegment("key-9")
+	assert.NoError(t, err)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "key-9", text.Content)
+	assert.NoError(t, fss.CloseFS())
+
+	_, err = NewKeyring(newSecret, newSecret)
+	assert.Error(t, err)
+	_, err = NewKeyring(newSecret, []byte("short"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Keyring holds the secrets values are encrypted with. New values are encrypted
+// with the active secret, retired secrets are only used to decrypt the values
+// written before a rotation. Every value records the KeyID of its secret.
+type Keyring struct {
+	active  uint32
+	secrets map[uint32][]byte
+}
+
+// NewKeyring returns a keyring that encrypts with active and still decrypts with retired.
+func NewKeyring(active []byte, retired ...[]byte) (*Keyring, error) {
+	k := &Keyring{
+		active:  KeyID(active),
+		secrets: make(map[uint32][]byte, len(retired)+1),
+	}
+
+	for _, secret := range append([][]byte{active}, retired...) {
+		if len(secret) < 16 {
+			return nil, errors.New("secret key char length too short")
+		}
+
+		id := KeyID(secret)
+		if _, ok := k.secrets[id]; ok {
+			return nil, fmt.Errorf("secret with key id %08x is duplicated", id)
+		}
+		k.secrets[id] = secret
+	}
+
+	return k, nil
+}
+
+// ActiveID returns the KeyID of the secret new values are encrypted with.
+func (k *Keyring) ActiveID() uint32 {
+	return k.active
+}
+
+// IDs returns the KeyID of every secret in ascending order.
+func (k *Keyring) IDs() []uint32 {
+	ids := make([]uint32, 0, len(k.secrets))
+	for id := range k.secrets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// secret returns the secret with KeyID id, a nil keyring has none.
+func (k *Keyring) secret(id uint32) ([]byte, bool) {
+	if k == nil {
+		return nil, false
+	}
+	secret, ok := k.secrets[id]
+	return secret, ok
+}
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -37,23 +38,66 @@ const (
 	GC_INIT GC_STATE = iota // gc 第一次执行就是这个状态
 	GC_ACTIVE
 	GC_INACTIVE
-	SEGMENT_PADDING = 26
+	SEGMENT_PADDING = 45 // Segment header, from DEL up to FLG
+	INDEX_PADDING   = 60 // Fixed part of an index record, from INUM up to KLEN
+	INDEX_HEADER    = 33 // Index file header: | META 4 | RID 8 | OFS 8 | LSN 8 | ENC 1 | KID 4 |
+	INDEX_TRAILER   = 12 // Index file trailer: | COUNT 8 | CRC32 4 |
 )
 
+// FormatVersion is the version of the region format written by this build, it is
+// the last byte of the region file header. Older regions are rewritten by UpgradeFS.
+//
+//	1: | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+//	2: | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | KEY ? | VALUE ? | CRC32 4 |
+//	3: | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | KEY ? | VALUE ? | CRC32 4 |
+//	4: | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | KEY ? | VALUE ? | CRC32 4 |
+//	5: | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
+const FormatVersion uint8 = 5
+
+// ErrOutdatedFormat is returned by OpenFS for a region written in an older format.
+var ErrOutdatedFormat = errors.New("data file format is outdated")
+
+// ErrKeyNotFound is returned by FetchSegment and the TTL operations for a missing or expired key.
+var ErrKeyNotFound = errors.New("key not found")
+
 var (
-	indexShard       = 10
-	fsPerm           = fs.FileMode(0755)
-	fileExtension    = ".wdb"
-	indexFileName    = "index.wdb"
-	regionThreshold  = int64(1 * GB) // 1GB
-	dataFileMetadata = []byte{0xDB, 0x00, 0x01, 0x01}
-	transformer      = NewTransformer()
+	indexShard        = 10
+	fsPerm            = fs.FileMode(0755)
+	fileExtension     = ".wdb"
+	indexFileName     = "index.wdb"
+	regionThreshold   = int64(1 * GB) // 1GB
+	dataFileMetadata  = []byte{0xDB, 0x00, 0x01, FormatVersion}
+	indexFileMetadata = []byte{0xDB, 0x00, 0x01, 0x07} // Index snapshot with mark, trailer, sliding TTL, LSN and encryption
+	transformer       = NewTransformer()
+	// Segment header size of every readable region format version
+	segmentHeaderSizes = map[uint8]int64{1: 26, 2: 30, 3: 38, 4: 44, FormatVersion: SEGMENT_PADDING}
 )
 
 type Options struct {
 	Path      string
 	FSPerm    os.FileMode
 	Threshold uint8
+	// RecoverSkipCorrupt skips corrupted segments found in the middle of the
+	// regions during recovery instead of refusing to open the file system.
+	RecoverSkipCorrupt bool
+	// Fsync decides when appended segments are flushed to disk,
+	// FsyncInterval is the flush period of FsyncEveryInterval.
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// A region is only compacted once its garbage ratio reaches GarbageRatio
+	// and it holds at least MinGarbage dead bytes. Without GarbageRatio
+	// DefaultGarbageRatio is used, 0 compacts any region with dead bytes.
+	GarbageRatio *float64
+	MinGarbage   uint64
+	// GCRateLimit is the budget in bytes per second of the compaction reads and
+	// rewrites, 0 means unlimited. It can be changed with SetGCRateLimit.
+	GCRateLimit uint64
+	// Encryptor and Keyring are configured before recovery, a directory with
+	// encrypted keys can not be recovered without them. EncryptKeys also
+	// encrypts the keys of new segments and the index snapshot.
+	Encryptor   Encryptor
+	Keyring     *Keyring
+	EncryptKeys bool
 }
 
 // INode represents a file system node with metadata.
@@ -63,71 +107,178 @@ type INode struct {
 	Length    uint32 // Data record length
 	ExpiredAt uint64 // Expiration time of the INode (UNIX timestamp in nano seconds)
 	CreatedAt uint64 // Creation time of the INode (UNIX timestamp in nano seconds)
-	mvcc      uint64 // Multi-version concurrency ID
+	Key       string // Original key of the record, used to enumerate the keyspace
+	// SlidingTTL is the sliding expiration window in seconds. Reads of a sliding
+	// key push ExpiredAt forward in place, the only field updated after insert.
+	SlidingTTL uint32
+	LSN        uint64 // Log sequence number of the segment, also the version of the key
+	next       *INode // Next inode whose key has the same inode number
 }
 
+// indexMap is a shard of the in-memory index. Keys whose inode numbers
+// collide are kept in a chain linked through INode.next, so every lookup
+// has to compare the original key, the helpers below must be called with mu held.
 type indexMap struct {
 	mu    sync.RWMutex
 	index map[uint64]*INode
+	size  int
+}
+
+// lookup returns the inode of key within the chain of inum.
+func (imap *indexMap) lookup(inum uint64, key string) (*INode, bool) {
+	for inode := imap.index[inum]; inode != nil; inode = inode.next {
+		if inode.Key == key {
+			return inode, true
+		}
+	}
+	return nil, false
+}
+
+// insert puts inode into the chain of inum, replacing and returning the inode of the same key.
+func (imap *indexMap) insert(inum uint64, inode *INode) *INode {
+	var prev *INode
+	for node := imap.index[inum]; node != nil; node = node.next {
+		if node.Key == inode.Key {
+			inode.next = node.next
+			if prev == nil {
+				imap.index[inum] = inode
+			} else {
+				prev.next = inode
+			}
+			return node
+		}
+		prev = node
+	}
+
+	inode.next = imap.index[inum]
+	imap.index[inum] = inode
+	imap.size++
+	return nil
+}
+
+// remove unlinks the inode of key from the chain of inum.
+func (imap *indexMap) remove(inum uint64, key string) (*INode, bool) {
+	var prev *INode
+	for node := imap.index[inum]; node != nil; node = node.next {
+		if node.Key == key {
+			if prev != nil {
+				prev.next = node.next
+			} else if node.next != nil {
+				imap.index[inum] = node.next
+			} else {
+				delete(imap.index, inum)
+			}
+			imap.size--
+			return node, true
+		}
+		prev = node
+	}
+	return nil, false
+}
+
+// rangeNodes calls fn for every inode of the shard until fn returns false.
+func (imap *indexMap) rangeNodes(fn func(inum uint64, inode *INode) bool) {
+	for inum, head := range imap.index {
+		for inode := head; inode != nil; inode = inode.next {
+			if !fn(inum, inode) {
+				return
+			}
+		}
+	}
 }
 
 // LogStructuredFS represents the virtual file storage system.
 type LogStructuredFS struct {
-	mu          sync.RWMutex
-	offset      uint64
-	regionID    uint64
-	directory   string
-	indexs      []*indexMap
-	active      *os.File
-	regions     map[uint64]*os.File
-	gcstate     GC_STATE
-	gcdone      chan struct{}
-	dirtyRegion []*os.File
+	mu           sync.RWMutex
+	offset       uint64
+	regionID     uint64
+	lastRegionID uint64       // Highest region id allocated, for active and gc output regions
+	drain        sync.RWMutex // Held shared while reading regions, exclusively to remove regions
+	directory    string
+	indexs       []*indexMap
+	active       *os.File
+	regions      map[uint64]*os.File
+	gc           *regionGC   // Region garbage collection worker and its stats
+	snapshotMu   sync.Mutex  // Serializes index snapshot exports
+	checkpoint   *checkpoint // Background index checkpoint worker
+	skipCorrupt  bool        // Skip corrupted segments during recovery
+	sequence     uint64      // Log sequence number of the last appended segment
+	fsync        FsyncPolicy
+	syncer       *groupCommit
+	stats        *regionStats // Live and dead bytes of every region
+	feed         *changeFeed  // Newest LSN of the regions read by the change feed
+	gcRatio      float64      // Garbage ratio a region needs to be compacted
+	gcMinGarbage uint64       // Dead bytes a region needs to be compacted
+	expiry       *expiry      // Expiration times of the keys with a TTL
 }
 
 // PutSegment inserts a Segment record into the LogStructuredFS virtual file system.
 func (lfs *LogStructuredFS) PutSegment(key string, seg *Segment) error {
+	seq, err := lfs.putSegment(key, seg)
+	if err != nil {
+		return err
+	}
+	return lfs.commitWrite(seq)
+}
+
+func (lfs *LogStructuredFS) putSegment(key string, seg *Segment) (uint64, error) {
 	inum := InodeNum(key)
 
-	bytes, err := serializedSegment(seg)
+	err := encodeSegmentKey(seg)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 
+	// The log sequence number is assigned in append order, so the segment is serialized under the lock.
+	lfs.sequence++
+	seg.LSN = lfs.sequence
+	bytes, err := serializedSegment(seg)
+	if err != nil {
+		return 0, err
+	}
+
 	// Append data to the active region with a lock.
 	err = appendToActiveRegion(lfs.active, bytes)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Select an index shard based on the hash function and update it.
 	// To avoid locking the entire index, only the relevant shard is locked.
 	imap := lfs.indexs[inum%uint64(indexShard)]
 	imap.mu.Lock()
-	// Update the inode metadata within a critical section.
-	imap.index[inum] = &INode{
-		RegionID:  lfs.regionID,
-		Position:  lfs.offset,
-		Length:    seg.Size(),
-		CreatedAt: seg.CreatedAt,
-		ExpiredAt: seg.ExpiredAt,
-		mvcc:      0,
-	}
+	// Update the inode metadata within a critical section,
+	// the log sequence number of the write is the new version of the key.
+	old := imap.insert(inum, &INode{
+		RegionID:   lfs.regionID,
+		Position:   lfs.offset,
+		Length:     seg.Size(),
+		CreatedAt:  seg.CreatedAt,
+		ExpiredAt:  seg.ExpiredAt,
+		Key:        key,
+		SlidingTTL: seg.SlidingTTL,
+		LSN:        seg.LSN,
+	})
 	imap.mu.Unlock()
 
+	lfs.stats.release(old)
+	lfs.stats.addLive(lfs.regionID, seg.Size())
+	lfs.expiry.push(inum, key, seg.LSN, seg.ExpiredAt)
+
 	lfs.offset += uint64(seg.Size())
+	lfs.notifyCheckpoint()
 
 	if lfs.offset >= uint64(regionThreshold) {
 		err := lfs.createActiveRegion()
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return nil
+	return lfs.sequence, nil
 }
 
 func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, error) {
@@ -143,36 +294,68 @@ func (lfs *LogStructuredFS) BatchFetchSegments(keys ...string) ([]*Segment, erro
 }
 
 func (lfs *LogStructuredFS) DeleteSegment(key string) error {
-	seg := NewTombstoneSegment(key)
-
-	bytes, err := serializedSegment(seg)
+	seq, err := lfs.deleteSegment(key)
 	if err != nil {
 		return err
 	}
+	return lfs.commitWrite(seq)
+}
 
-	lfs.mu.Lock()
-	err = appendToActiveRegion(lfs.active, bytes)
-	lfs.mu.Unlock()
+func (lfs *LogStructuredFS) deleteSegment(key string) (uint64, error) {
+	seg := NewTombstoneSegment(key)
+	err := encodeSegmentKey(seg)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	atomic.AddUint64(&lfs.offset, uint64(seg.Size()))
-
 	inum := InodeNum(key)
 	imap := lfs.indexs[inum%uint64(indexShard)]
 	if imap == nil {
-		return fmt.Errorf("inode index shard for %d not found", inum)
+		return 0, fmt.Errorf("inode index shard for %d not found", inum)
+	}
+
+	// The tombstone and the index update must be applied in the same critical
+	// section, otherwise a snapshot could observe one without the other.
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	lfs.sequence++
+	seg.LSN = lfs.sequence
+	bytes, err := serializedSegment(seg)
+	if err != nil {
+		return 0, err
+	}
+
+	err = appendToActiveRegion(lfs.active, bytes)
+	if err != nil {
+		return 0, err
 	}
 
+	// The tombstone itself is never referenced by the index.
+	lfs.stats.addDead(lfs.regionID, uint64(seg.Size()))
+	lfs.offset += uint64(seg.Size())
+
 	imap.mu.Lock()
-	delete(imap.index, inum)
+	old, _ := imap.remove(inum, key)
 	imap.mu.Unlock()
+	lfs.stats.release(old)
 
-	return nil
+	lfs.notifyCheckpoint()
+
+	if lfs.offset >= uint64(regionThreshold) {
+		return lfs.sequence, lfs.createActiveRegion()
+	}
+
+	return lfs.sequence, nil
 }
 
+// FetchSegment returns the version and the segment of key, ErrKeyNotFound is
+// returned for a missing or expired key and any other error is a read failure.
 func (lfs *LogStructuredFS) FetchSegment(key string) (uint64, *Segment, error) {
+	// Garbage collection waits for in-flight reads before it removes a region.
+	lfs.drain.RLock()
+	defer lfs.drain.RUnlock()
+
 	inum := InodeNum(key)
 	imap := lfs.indexs[inum%uint64(indexShard)]
 	if imap == nil {
@@ -180,21 +363,29 @@ func (lfs *LogStructuredFS) FetchSegment(key string) (uint64, *Segment, error) {
 	}
 
 	imap.mu.RLock()
-	inode, ok := imap.index[inum]
+	inode, ok := imap.lookup(inum, key)
 	imap.mu.RUnlock()
 	if !ok {
-		return 0, nil, fmt.Errorf("inode index for %d not found", inum)
+		return 0, nil, fmt.Errorf("%w: inode index for %d not found", ErrKeyNotFound, inum)
 	}
 
 	if atomic.LoadUint64(&inode.ExpiredAt) <= uint64(time.Now().UnixNano()) &&
 		atomic.LoadUint64(&inode.ExpiredAt) != 0 {
 		imap.mu.Lock()
-		delete(imap.index, inum)
+		// Only drop the inode if it has not been replaced in the meantime.
+		if current, ok := imap.lookup(inum, key); ok && current == inode {
+			imap.remove(inum, key)
+			lfs.stats.release(inode)
+		}
 		imap.mu.Unlock()
-		return 0, nil, fmt.Errorf("inode index for %d has expired", inum)
+		return 0, nil, fmt.Errorf("%w: inode index for %d has expired", ErrKeyNotFound, inum)
 	}
 
+	// Regions are removed by garbage collection, the map is only read under lfs.mu.
+	lfs.mu.RLock()
 	fd, ok := lfs.regions[atomic.LoadUint64(&inode.RegionID)]
+	cp := lfs.checkpoint
+	lfs.mu.RUnlock()
 	if !ok {
 		return 0, nil, fmt.Errorf("data region with ID %d not found", inode.RegionID)
 	}
@@ -204,125 +395,201 @@ func (lfs *LogStructuredFS) FetchSegment(key string) (uint64, *Segment, error) {
 		return 0, nil, fmt.Errorf("failed to read segment: %w", err)
 	}
 
+	// Never hand out a segment that belongs to a different key.
+	if string(segment.Key) != key {
+		return 0, nil, fmt.Errorf("inode index for %d points to a segment of another key", inum)
+	}
+
+	if inode.SlidingTTL > 0 {
+		segment.ExpiredAt = slideExpiry(inode, cp)
+	}
+
 	// Return the fetched segment and multi-version concurrency ID
-	return atomic.LoadUint64(&inode.mvcc), segment, nil
+	return atomic.LoadUint64(&inode.LSN), segment, nil
 }
 
 func (lfs *LogStructuredFS) KeysCount() int {
 	keys := 0
 	for _, imap := range lfs.indexs {
 		imap.mu.RLock()
-		keys += len(imap.index)
+		keys += imap.size
 		imap.mu.RUnlock()
 	}
 	return keys
 }
 
+// Keys returns the keys held by the in-memory index that start with prefix.
+// An empty prefix returns the whole keyspace, expired keys are skipped.
+func (lfs *LogStructuredFS) Keys(prefix string) []string {
+	var keys []string
+	lfs.RangeKeys(prefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// RangeKeys calls fn sequentially for each key that starts with prefix.
+// If fn returns false, range stops the iteration. Keys of a shard are copied
+// under its read lock and fn is called outside of it, so fn may safely call
+// back into LogStructuredFS. The order of keys is not specified.
+func (lfs *LogStructuredFS) RangeKeys(prefix string, fn func(key string) bool) {
+	for _, imap := range lfs.indexs {
+		now := uint64(time.Now().UnixNano())
+		var keys []string
+
+		imap.mu.RLock()
+		imap.rangeNodes(func(_ uint64, inode *INode) bool {
+			expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+			if expiredAt != 0 && expiredAt <= now {
+				return true
+			}
+			if strings.HasPrefix(inode.Key, prefix) {
+				keys = append(keys, inode.Key)
+			}
+			return true
+		})
+		imap.mu.RUnlock()
+
+		for _, key := range keys {
+			if !fn(key) {
+				return
+			}
+		}
+	}
+}
+
 func InodeNum(key string) uint64 {
 	return murmur3.Sum64([]byte(key))
 }
 
 // UpdateSegmentWithCAS 通过类似于 MVCC 来实现更新操作数据一致性
 func (lfs *LogStructuredFS) UpdateSegmentWithCAS(key string, expected uint64, newseg *Segment) error {
+	seq, err := lfs.updateSegmentWithCAS(key, expected, newseg)
+	if err != nil {
+		return err
+	}
+	return lfs.commitWrite(seq)
+}
+
+func (lfs *LogStructuredFS) updateSegmentWithCAS(key string, expected uint64, newseg *Segment) (uint64, error) {
 	inum := InodeNum(key)
 	imap := lfs.indexs[inum%uint64(indexShard)]
 	if imap == nil {
-		return fmt.Errorf("inode index shard for %d not found", inum)
+		return 0, fmt.Errorf("inode index shard for %d not found", inum)
 	}
 
-	// 读取 inode 信息，使用读锁来防止并发写操作
+	err := encodeSegmentKey(newseg)
+	if err != nil {
+		return 0, err
+	}
+
+	// 所有写入都持有 lfs.mu，版本检查、追加数据和修改 inode 信息在同一个临界区内完成
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
 	imap.mu.RLock()
-	inode, ok := imap.index[inum]
+	inode, ok := imap.lookup(inum, key)
 	imap.mu.RUnlock()
 	if !ok {
-		return fmt.Errorf("inode index for %d not found", inum)
+		return 0, fmt.Errorf("inode index for %d not found", inum)
 	}
 
 	// MVCC: version is not modified by another thread
-	if atomic.CompareAndSwapUint64(&inode.mvcc, expected, expected+1) {
-		bytes, err := serializedSegment(newseg)
-		if err != nil {
-			return err
-		}
-		// 更新数据时使用锁
-		lfs.mu.Lock()
-		err = appendToActiveRegion(lfs.active, bytes)
-		lfs.mu.Unlock()
-		if err != nil {
-			return fmt.Errorf("failed to update data: %w", err)
-		}
-
-		// 修改 inode 信息时使用写锁
-		atomic.StoreUint64(&inode.Position, atomic.LoadUint64(&lfs.offset))
-		atomic.StoreUint64(&inode.CreatedAt, newseg.CreatedAt)
-		atomic.StoreUint64(&inode.ExpiredAt, newseg.ExpiredAt)
-		atomic.StoreUint64(&inode.RegionID, lfs.regionID)
-		atomic.StoreUint32(&inode.Length, newseg.Size())
-
-		// 使用原子操作更新 offset
-		atomic.AddUint64(&lfs.offset, uint64(newseg.Size()))
-
-		// 检查并创建新的区域
-		if atomic.LoadUint64(&lfs.offset) >= uint64(regionThreshold) {
-			lfs.mu.Lock()
-			err := lfs.createActiveRegion()
-			lfs.mu.Unlock()
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
+	if atomic.LoadUint64(&inode.LSN) != expected {
+		return 0, errors.New("failed to update data due to version conflict")
 	}
 
-	return errors.New("failed to update data due to version conflict")
-}
-
-func (lfs *LogStructuredFS) changeRegions() error {
-	lfs.mu.Lock()
-	defer lfs.mu.Unlock()
+	lfs.sequence++
+	newseg.LSN = lfs.sequence
+	bytes, err := serializedSegment(newseg)
+	if err != nil {
+		return 0, err
+	}
 
-	err := lfs.active.Sync()
+	err = appendToActiveRegion(lfs.active, bytes)
 	if err != nil {
-		return fmt.Errorf("failed to change active regions: %w", err)
+		return 0, fmt.Errorf("failed to update data: %w", err)
 	}
 
-	lfs.regions[lfs.regionID] = lfs.active
+	// 替换整个 inode 而不是原地修改，读取者看到的位置和版本号始终是一致的
+	imap.mu.Lock()
+	old := imap.insert(inum, &INode{
+		RegionID:   lfs.regionID,
+		Position:   lfs.offset,
+		Length:     newseg.Size(),
+		CreatedAt:  newseg.CreatedAt,
+		ExpiredAt:  newseg.ExpiredAt,
+		SlidingTTL: newseg.SlidingTTL,
+		Key:        key,
+		LSN:        newseg.LSN,
+	})
+	imap.mu.Unlock()
 
-	err = lfs.createActiveRegion()
-	if err != nil {
-		return fmt.Errorf("failed to chanage active regions: %w", err)
+	lfs.stats.release(old)
+	lfs.stats.addLive(lfs.regionID, newseg.Size())
+	lfs.expiry.push(inum, key, newseg.LSN, newseg.ExpiredAt)
+
+	lfs.offset += uint64(newseg.Size())
+	lfs.notifyCheckpoint()
+
+	// 检查并创建新的区域
+	if lfs.offset >= uint64(regionThreshold) {
+		return lfs.sequence, lfs.createActiveRegion()
 	}
 
-	return nil
+	return lfs.sequence, nil
 }
 
 func (lfs *LogStructuredFS) createActiveRegion() error {
-	lfs.regionID += 1
-	fileName, err := generateFileName(lfs.regionID)
+	// Writes waiting for a group commit only flush the active region,
+	// the region being rotated out must be on disk before it is replaced.
+	if lfs.active != nil {
+		err := lfs.active.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync rotated region: %w", err)
+		}
+	}
+
+	regionID := lfs.lastRegionID + 1
+	fileName, err := generateFileName(regionID)
 	if err != nil {
 		return fmt.Errorf("failed to new active region name: %w", err)
 	}
 
-	active, err := os.OpenFile(filepath.Join(lfs.directory, fileName), RWCA, fsPerm)
+	active, err := createRegionFile(filepath.Join(lfs.directory, fileName))
 	if err != nil {
 		return fmt.Errorf("failed to create active region: %w", err)
 	}
 
-	n, err := active.Write(dataFileMetadata)
+	lfs.regionID, lfs.lastRegionID = regionID, regionID
+	lfs.active = active
+	lfs.stats.track(regionID)
+	lfs.offset = uint64(len(dataFileMetadata))
+	lfs.regions[lfs.regionID] = lfs.active
+
+	return nil
+}
+
+// createRegionFile creates a region file and writes its metadata header.
+func createRegionFile(path string) (*os.File, error) {
+	fd, err := os.OpenFile(path, RWCA, fsPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := fd.Write(dataFileMetadata)
 	if err != nil {
-		return fmt.Errorf("failed to write active region metadata: %w", err)
+		fd.Close()
+		return nil, fmt.Errorf("failed to write region metadata: %w", err)
 	}
 
 	if n != len(dataFileMetadata) {
-		return errors.New("failed to active region metadata write")
+		fd.Close()
+		return nil, errors.New("failed to region metadata write")
 	}
 
-	lfs.active = active
-	lfs.offset = uint64(len(dataFileMetadata))
-	lfs.regions[lfs.regionID] = lfs.active
-
-	return nil
+	return fd, nil
 }
 
 func (lfs *LogStructuredFS) recoverRegions() error {
@@ -333,6 +600,16 @@ func (lfs *LogStructuredFS) recoverRegions() error {
 	}
 
 	for _, file := range files {
+		// Output regions of an interrupted garbage collection were never published,
+		// the regions they were copied from still exist.
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension+gcFileExtension) {
+			err := os.Remove(filepath.Join(lfs.directory, file.Name()))
+			if err != nil {
+				return fmt.Errorf("failed to remove unfinished gc region: %w", err)
+			}
+			continue
+		}
+
 		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
 			if strings.HasPrefix(file.Name(), "0") {
 				regions, err := os.OpenFile(filepath.Join(lfs.directory, file.Name()), os.O_RDWR, fsPerm)
@@ -362,6 +639,7 @@ func (lfs *LogStructuredFS) recoverRegions() error {
 
 		// Find the latest version of the data file
 		lfs.regionID = regionIds[len(regionIds)-1]
+		lfs.lastRegionID = lfs.regionID
 
 		// Create a new file if the largest region file exceeds the threshold, otherwise, no need to create a new file
 		active, ok := lfs.regions[lfs.regionID]
@@ -393,7 +671,8 @@ func (lfs *LogStructuredFS) recoverRegions() error {
 
 // recoveryIndex performs index recovery operations on data files stored on disk.
 // Steps:
-//  1. Read the index snapshot file to restore the index.
+//  1. Read the index snapshot file to restore the index, then replay the segments
+//     appended after the high-water mark (region id + offset) of the snapshot.
 //  2. Unlike bitcask, where hint files are generated during the compressor process,
 //     in bitcask, hint files are created during compression but do not represent
 //     the full state of the in-memory index.
@@ -408,90 +687,186 @@ func (lfs *LogStructuredFS) recoveryIndex() error {
 	filePath := filepath.Join(lfs.directory, indexFileName)
 	if utils.IsExist(filePath) {
 		// If the index file exists, restore it
-		file, err := os.Open(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to open index file: %w", err)
+		err := lfs.recoverySnapshot(filePath)
+		if err == nil {
+			return nil
 		}
-		defer file.Close()
 
-		err = recoveryIndex(file, lfs.indexs)
-		if err != nil {
-			return fmt.Errorf("failed to recover index mapping: %w", err)
-		}
-
-		return nil
+		// The regions are the source of truth, a damaged or outdated snapshot
+		// is never fatal, whatever was loaded from it is dropped and rebuilt.
+		clog.Warnf("index snapshot is not usable, rebuilding from regions: %s", err)
+		lfs.resetIndex()
 	}
 
 	// If the index file does not exist, recover by globally scanning the regions files
 	// If the data files are very large and numerous, recovery time increases significantly.
 	// Frequent garbage collection reduces the size of data files and speeds up startup time.
 	// However, frequent garbage collection may negatively impact overall read/write performance.
-	return crashRecoveryAllIndex(lfs.regions, lfs.indexs)
+	return lfs.crashRecoveryAllIndex()
+}
+
+// recoverySnapshot restores the index from the snapshot file at filePath.
+func (lfs *LogStructuredFS) recoverySnapshot(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open index file: %w", err)
+	}
+	defer file.Close()
+
+	// Snapshots written by an older version have a different layout.
+	err = validateFileHeader(file, indexFileMetadata)
+	if err != nil {
+		return err
+	}
+
+	regionID, offset, lsn, err := recoveryIndex(file, lfs.indexs)
+	if err != nil {
+		return fmt.Errorf("failed to recover index mapping: %w", err)
+	}
+	lfs.sequence = lsn
+
+	// Garbage collection may have removed regions after the snapshot was written.
+	err = lfs.checkIndexRegions()
+	if err != nil {
+		return err
+	}
+
+	// The snapshot may be older than the regions if the process was not
+	// shut down cleanly, so every segment written after the high-water mark
+	// recorded in the snapshot is replayed on top of it.
+	return lfs.replayRegions(regionID, offset)
+}
+
+// checkIndexRegions verifies that every inode points to an existing region.
+func (lfs *LogStructuredFS) checkIndexRegions() error {
+	var missing uint64
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			if _, ok := lfs.regions[inode.RegionID]; !ok {
+				missing = inode.RegionID
+				return false
+			}
+			return true
+		})
+		imap.mu.RUnlock()
+		if missing != 0 {
+			return fmt.Errorf("index snapshot refers to missing region %d", missing)
+		}
+	}
+	return nil
+}
+
+// resetIndex drops every inode of the in-memory index.
+func (lfs *LogStructuredFS) resetIndex() {
+	for _, imap := range lfs.indexs {
+		imap.mu.Lock()
+		imap.index = make(map[uint64]*INode, len(imap.index))
+		imap.size = 0
+		imap.mu.Unlock()
+	}
+	lfs.sequence = 0
 }
 
-func (lfs *LogStructuredFS) SetCompressor(compressor Compressor) {
-	transformer.SetCompressor(compressor)
+func (lfs *LogStructuredFS) SetCompressor(compressor Compressor) error {
+	return transformer.SetCompressor(compressor)
+}
+
+// SetCompressionThreshold stores new values shorter than size bytes uncompressed.
+func (lfs *LogStructuredFS) SetCompressionThreshold(size int) {
+	transformer.SetCompressionThreshold(size)
 }
 
 func (lfs *LogStructuredFS) SetEncryptor(encryptor Encryptor, secret []byte) error {
 	return transformer.SetEncryptor(encryptor, secret)
 }
 
+// SetKeyring encrypts new values with the active secret of keyring, the values of
+// its retired secrets stay readable until ReencryptRegions rewrites them.
+func (lfs *LogStructuredFS) SetKeyring(encryptor Encryptor, keyring *Keyring) error {
+	return transformer.SetKeyring(encryptor, keyring)
+}
+
+// StartRegionGC starts the background worker that compacts dirty regions every
+// cycle_second, it does nothing if the worker is already running.
 func (lfs *LogStructuredFS) StartRegionGC(cycle_second time.Duration) {
-	// Return if the garbage collector is not in the initial state.
-	if lfs.gcstate != GC_INIT {
+	gc := lfs.gc
+	gc.ctl.Lock()
+	defer gc.ctl.Unlock()
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.done != nil {
 		return
 	}
 
 	// Create a ticker that triggers at the specified interval.
 	ticker := time.NewTicker(cycle_second)
 	// Channel to control the graceful exit of the garbage collection goroutine.
-	lfs.gcdone = make(chan struct{}, 1)
+	done := make(chan struct{})
+	gc.done, gc.interval = done, cycle_second
+	if gc.state != GC_ACTIVE {
+		gc.state = GC_INACTIVE
+	}
 
 	// Start a goroutine to continuously receive messages from the ticker channel.
+	gc.wg.Add(1)
 	go func() {
+		defer gc.wg.Done()
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				// Skip this cycle if the previous garbage collection is still running.
-				if lfs.gcstate == GC_ACTIVE {
-					continue
-				}
-
-				// Execute the garbage collection logic.
-				err := lfs.cleanupDirtyRegion()
-				if err != nil {
+				// Skip this cycle if a garbage collection is still running.
+				_, err := lfs.RunRegionGC()
+				if err != nil && !errors.Is(err, ErrGCRunning) {
 					clog.Warnf("failed to compress dirty region: %s", err)
 				}
-
-				// Update the state to indicate garbage collection has stopped.
-				lfs.gcstate = GC_INACTIVE
-			case <-lfs.gcdone:
-				// If garbage collection is running, delay its exit to prevent dirty data
-				// From being generated due to interrupted operations.
-				for lfs.gcstate == GC_ACTIVE {
-					time.Sleep(3 * time.Second)
-				}
-				// Reset the garbage collector state to the initial state.
-				lfs.gcstate = GC_INIT
+			case <-done:
 				return
 			}
 		}
 	}()
 }
 
+// StopRegionGC stops the background worker, a running garbage collection is
+// never interrupted, it is waited for to prevent dirty data.
 func (lfs *LogStructuredFS) StopRegionGC() {
-	if lfs.gcstate == GC_ACTIVE || lfs.gcstate == GC_INACTIVE {
-		lfs.gcdone <- struct{}{}
-		close(lfs.gcdone)
+	gc := lfs.gc
+	gc.ctl.Lock()
+	defer gc.ctl.Unlock()
+
+	gc.mu.Lock()
+	done := gc.done
+	gc.done = nil
+	gc.mu.Unlock()
+	if done == nil {
+		return
 	}
+
+	close(done)
+	gc.wg.Wait()
+
+	gc.mu.Lock()
+	if gc.state != GC_ACTIVE {
+		gc.state = GC_INIT
+	}
+	gc.mu.Unlock()
+}
+
+// RegionGCInterval returns the interval of the last started background worker, zero if it never started.
+func (lfs *LogStructuredFS) RegionGCInterval() time.Duration {
+	lfs.gc.mu.Lock()
+	defer lfs.gc.mu.Unlock()
+	return lfs.gc.interval
 }
 
 // GCState returns the current garbage collection (GC) state
 // of the LogStructuredFS regions compressor worker.
 func (lfs *LogStructuredFS) GCState() GC_STATE {
-	return lfs.gcstate
+	lfs.gc.mu.Lock()
+	defer lfs.gc.mu.Unlock()
+	return lfs.gc.state
 }
 
 func OpenFS(opt *Options) (*LogStructuredFS, error) {
@@ -503,15 +878,40 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		return nil, err
 	}
 
+	if opt.Keyring != nil {
+		if opt.Encryptor == nil {
+			return nil, errors.New("keyring is configured without encryptor")
+		}
+		err = transformer.SetKeyring(opt.Encryptor, opt.Keyring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.EncryptKeys {
+		if opt.Keyring == nil {
+			return nil, errors.New("key encryption requires a keyring")
+		}
+		transformer.EnableKeyEncryption()
+	}
+
 	fsPerm = opt.FSPerm
 	instance := &LogStructuredFS{
-		mu:        sync.RWMutex{},
-		indexs:    make([]*indexMap, indexShard),
-		regions:   make(map[uint64]*os.File, 10),
-		offset:    uint64(len(dataFileMetadata)),
-		regionID:  0,
-		directory: opt.Path,
-		gcstate:   GC_INIT,
+		mu:           sync.RWMutex{},
+		indexs:       make([]*indexMap, indexShard),
+		regions:      make(map[uint64]*os.File, 10),
+		offset:       uint64(len(dataFileMetadata)),
+		regionID:     0,
+		directory:    opt.Path,
+		gc:           newRegionGC(opt.GCRateLimit),
+		skipCorrupt:  opt.RecoverSkipCorrupt,
+		stats:        newRegionStats(),
+		feed:         newChangeFeed(),
+		gcRatio:      DefaultGarbageRatio,
+		gcMinGarbage: opt.MinGarbage,
+		fsync:        opt.Fsync,
+		syncer:       newGroupCommit(),
+		expiry:       newExpiry(),
 	}
 
 	for i := 0; i < indexShard; i++ {
@@ -532,6 +932,26 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 		return nil, fmt.Errorf("failed to recover regions index: %w", err)
 	}
 
+	if opt.GarbageRatio != nil {
+		instance.gcRatio = *opt.GarbageRatio
+	}
+
+	err = instance.rebuildRegionStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute region stats: %w", err)
+	}
+
+	// An index restored from a snapshot may still hold keys that expired meanwhile.
+	instance.rebuildExpiry()
+
+	if opt.Fsync == FsyncEveryInterval {
+		interval := opt.FsyncInterval
+		if interval <= 0 {
+			interval = DefaultFsyncInterval
+		}
+		instance.startIntervalSync(interval)
+	}
+
 	// Singleton pattern, but other packages can still create an instance with new(LogStructuredFS), which makes this ineffective
 	return instance, nil
 }
@@ -539,13 +959,20 @@ func OpenFS(opt *Options) (*LogStructuredFS, error) {
 // Before closing, always check if GC (garbage collection) is executing.
 // If GC is executing, do not close blindly.
 func (lfs *LogStructuredFS) CloseFS() error {
+	// The final snapshot is exported below, no checkpoint or compaction may race with it.
+	lfs.StopExpireReaper()
+	lfs.StopRegionGC()
+	lfs.gc.started.Wait()
+	lfs.StopCheckpoint()
+	lfs.stopIntervalSync()
+
 	lfs.mu.Lock()
 	defer lfs.mu.Unlock()
 	for _, file := range lfs.regions {
 		err := utils.FlushToDisk(file)
 		if err != nil {
 			// In-memory indexes must be persisted
-			inner := lfs.ExportSnapshotIndex()
+			inner := lfs.exportSnapshotIndex(lfs.regionID, lfs.offset, lfs.sequence)
 			if inner != nil {
 				return fmt.Errorf("failed to close LogStructuredFS: %w", errors.Join(err, inner))
 			}
@@ -555,7 +982,7 @@ func (lfs *LogStructuredFS) CloseFS() error {
 
 	// If there is a snapshot of the index file, recover from the snapshot.
 	// otherwise, perform a global scan.
-	return lfs.ExportSnapshotIndex()
+	return lfs.exportSnapshotIndex(lfs.regionID, lfs.offset, lfs.sequence)
 }
 
 func (lfs *LogStructuredFS) GetDirectory() string {
@@ -571,54 +998,181 @@ func (lfs *LogStructuredFS) GetDirectory() string {
 // as it consumes a significant amount of virtual memory space and may lead to
 // swapping memory pages to disk.
 func (lfs *LogStructuredFS) ExportSnapshotIndex() error {
+	// Everything appended before the high-water mark is already reflected
+	// in the index, because writers update it while holding lfs.mu.
+	lfs.mu.RLock()
+	regionID, offset, lsn := lfs.regionID, lfs.offset, lfs.sequence
+	lfs.mu.RUnlock()
+
+	return lfs.exportSnapshotIndex(regionID, offset, lsn)
+}
+
+// exportSnapshotIndex writes the index snapshot with the given high-water mark and
+// the log sequence number of the last segment before it:
+// | META 4 | RID 8 | OFS 8 | LSN 8 | ENC 1 | KID 4 | INDEX RECORD ... | COUNT 8 | CRC32 4 |
+// With key encryption the records of every index shard are encrypted as a chunk
+// with the encryptor ENC and the secret KID: | CLEN 4 | CHUNK ? |.
+// The snapshot is written to a temporary file that is only renamed over the
+// previous snapshot once it is complete and synced, so a crash during the export
+// leaves the previous snapshot intact. The trailing CRC32 covers the whole file.
+func (lfs *LogStructuredFS) exportSnapshotIndex(regionID, offset, lsn uint64) (err error) {
+	lfs.snapshotMu.Lock()
+	defer lfs.snapshotMu.Unlock()
+
 	filePath := filepath.Join(lfs.directory, indexFileName)
-	fd, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fsPerm)
+	tempPath := filePath + ".tmp"
+
+	fd, err := os.OpenFile(tempPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fsPerm)
 	if err != nil {
 		return fmt.Errorf("failed to generate index snapshot file: %w", err)
 	}
-	defer utils.FlushToDisk(fd)
 
-	n, err := fd.Write(dataFileMetadata)
+	defer func() {
+		if err != nil {
+			fd.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(fd, checksum))
+
+	codec, sealed := transformer.keyCodec()
+
+	header := make([]byte, INDEX_HEADER)
+	copy(header, indexFileMetadata)
+	binary.LittleEndian.PutUint64(header[4:12], regionID)
+	binary.LittleEndian.PutUint64(header[12:20], offset)
+	binary.LittleEndian.PutUint64(header[20:28], lsn)
+	header[28] = codec.Encryptor
+	binary.LittleEndian.PutUint32(header[29:33], codec.KeyID)
+
+	_, err = writer.Write(header)
 	if err != nil {
 		return fmt.Errorf("failed to write index file metadata: %w", err)
 	}
 
-	if n != len(dataFileMetadata) {
-		return errors.New("index file metadata write incomplete")
-	}
-
+	// Each shard is serialized into memory under its read lock and written
+	// out after the lock is released, so writers are only blocked for the
+	// time it takes to copy one shard instead of the whole export.
+	var count uint64
 	for _, imap := range lfs.indexs {
+		var buf bytes.Buffer
 		imap.mu.RLock()
-		defer imap.mu.RUnlock()
-		for inum, inode := range imap.index {
-			bytes, err := serializedIndex(inum, inode)
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			var record []byte
+			record, err = serializedIndex(inum, inode)
+			if err != nil {
+				err = fmt.Errorf("failed to serialized index (inum: %d): %w", inum, err)
+				return false
+			}
+			buf.Write(record)
+			count++
+			return true
+		})
+		imap.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		records := buf.Bytes()
+		if sealed {
+			records, err = transformer.encrypt(codec, records)
 			if err != nil {
-				return fmt.Errorf("failed to serialized index (inum: %d): %w", inum, err)
+				return fmt.Errorf("failed to encrypt serialized index: %w", err)
 			}
-			_, err = fd.Write(bytes)
+			err = binary.Write(writer, binary.LittleEndian, uint32(len(records)))
 			if err != nil {
-				return fmt.Errorf("failed to write serialized index (inum: %d): %w", inum, err)
+				return fmt.Errorf("failed to write serialized index: %w", err)
 			}
 		}
+
+		_, err = writer.Write(records)
+		if err != nil {
+			return fmt.Errorf("failed to write serialized index: %w", err)
+		}
 	}
 
-	return nil
+	err = binary.Write(writer, binary.LittleEndian, count)
+	if err != nil {
+		return fmt.Errorf("failed to write index file trailer: %w", err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write index snapshot file: %w", err)
+	}
+
+	// The checksum itself is written past the hash writer.
+	err = binary.Write(fd, binary.LittleEndian, checksum.Sum32())
+	if err != nil {
+		return fmt.Errorf("failed to write index file checksum: %w", err)
+	}
+
+	err = utils.FlushToDisk(fd)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to replace index snapshot file: %w", err)
+	}
+
+	return utils.SyncDir(lfs.directory)
 }
 
-func recoveryIndex(fd *os.File, indexs []*indexMap) error {
-	offset := int64(len(dataFileMetadata))
+// recoveryIndex loads the index snapshot into indexs and returns its high-water mark
+// and the log sequence number recorded with it.
+func recoveryIndex(fd *os.File, indexs []*indexMap) (uint64, uint64, uint64, error) {
+	offset := int64(INDEX_HEADER)
 
 	finfo, err := fd.Stat()
 	if err != nil {
-		return err
+		return 0, 0, 0, err
+	}
+
+	if finfo.Size() < INDEX_HEADER+INDEX_TRAILER {
+		return 0, 0, 0, errors.New("index file is too short to contain header and trailer")
 	}
 
+	// Verify the whole file before loading anything from it.
+	checksum := crc32.NewIEEE()
+	_, err = io.Copy(checksum, io.NewSectionReader(fd, 0, finfo.Size()-4))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to checksum index file: %w", err)
+	}
+
+	header := make([]byte, INDEX_HEADER)
+	_, err = fd.ReadAt(header, 0)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read index file header: %w", err)
+	}
+
+	trailer := make([]byte, INDEX_TRAILER)
+	_, err = fd.ReadAt(trailer, finfo.Size()-INDEX_TRAILER)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to read index file trailer: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(trailer[8:12]) != checksum.Sum32() {
+		return 0, 0, 0, errors.New("index file checksum mismatch")
+	}
+
+	regionID := binary.LittleEndian.Uint64(header[4:12])
+	regionOffset := binary.LittleEndian.Uint64(header[12:20])
+	lsn := binary.LittleEndian.Uint64(header[20:28])
+	codec := Codec{Encryptor: header[28], KeyID: binary.LittleEndian.Uint32(header[29:33])}
+	count := binary.LittleEndian.Uint64(trailer[0:8])
+	end := finfo.Size() - INDEX_TRAILER
+	var records uint64
+
 	type index struct {
 		inum  uint64
 		inode *INode
 	}
 
-	nqueue := make(chan index, (finfo.Size()-offset)/48)
+	nqueue := make(chan index, (end-offset)/INDEX_PADDING)
 	equeue := make(chan error, 1)
 
 	var wg sync.WaitGroup
@@ -628,23 +1182,26 @@ func recoveryIndex(fd *os.File, indexs []*indexMap) error {
 		defer wg.Done()
 		defer close(nqueue)
 
-		for offset < finfo.Size() && len(equeue) == 0 {
-			buf := make([]byte, 48)
-			_, err := fd.ReadAt(buf, offset)
-			if err != nil {
-				equeue <- fmt.Errorf("failed to read index node: %w", err)
-				return
-			}
+		// Reading stops once the consumer has failed.
+		emit := func(inum uint64, inode *INode) bool {
+			records++
+			nqueue <- index{inum: inum, inode: inode}
+			return len(equeue) == 0
+		}
 
-			offset += 48
+		body := io.NewSectionReader(fd, offset, end-offset)
+		var err error
+		if codec.Encryptor == CodecNone {
+			err = readIndexRecords(bufio.NewReader(body), end-offset, emit)
+		} else {
+			err = readSealedIndexRecords(body, end-offset, codec, emit)
+		}
 
-			inum, inode, err := deserializedIndex(buf)
-			if err != nil {
-				equeue <- fmt.Errorf("failed to deserialize index (inum: %d): %w", inum, err)
-				return
+		if err != nil {
+			select {
+			case equeue <- err:
+			default:
 			}
-
-			nqueue <- index{inum: inum, inode: inode}
 		}
 	}()
 
@@ -654,7 +1211,7 @@ func recoveryIndex(fd *os.File, indexs []*indexMap) error {
 		for node := range nqueue {
 			imap := indexs[node.inum%uint64(indexShard)]
 			if imap != nil {
-				imap.index[node.inum] = node.inode
+				imap.insert(node.inum, node.inode)
 			} else {
 				// This corresponds to the condition len(queue) == 0 in the for loop.
 				// It prevents a situation where the consumer goroutine has encountered an error and stopped,
@@ -673,101 +1230,426 @@ func recoveryIndex(fd *os.File, indexs []*indexMap) error {
 	select {
 	case err := <-equeue:
 		close(equeue)
-		return err
+		return 0, 0, 0, err
 	default:
 		close(equeue)
-		return nil
 	}
+
+	if records != count {
+		return 0, 0, 0, fmt.Errorf("index file has %d records, trailer expects %d", records, count)
+	}
+
+	return regionID, regionOffset, lsn, nil
+}
+
+// readIndexRecords reads the index records in the size bytes of r and passes them to
+// emit, until emit returns false.
+func readIndexRecords(r io.Reader, size int64, emit func(inum uint64, inode *INode) bool) error {
+	for size > 0 {
+		// The fixed part of a record ends with the key length,
+		// the key and the checksum follow it.
+		buf := make([]byte, INDEX_PADDING)
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return fmt.Errorf("failed to read index node: %w", err)
+		}
+
+		klen := binary.LittleEndian.Uint32(buf[INDEX_PADDING-4:])
+		if int64(klen)+4 > size-INDEX_PADDING {
+			return fmt.Errorf("index node key length %d out of range", klen)
+		}
+
+		tail := make([]byte, klen+4)
+		_, err = io.ReadFull(r, tail)
+		if err != nil {
+			return fmt.Errorf("failed to read index node key: %w", err)
+		}
+
+		size -= INDEX_PADDING + int64(len(tail))
+
+		inum, inode, err := deserializedIndex(append(buf, tail...))
+		if err != nil {
+			return fmt.Errorf("failed to deserialize index (inum: %d): %w", inum, err)
+		}
+
+		if !emit(inum, inode) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// readSealedIndexRecords decrypts the chunks in the size bytes of r with codec and
+// reads the index records of each chunk like readIndexRecords.
+func readSealedIndexRecords(r io.Reader, size int64, codec Codec, emit func(inum uint64, inode *INode) bool) error {
+	stopped := false
+	for size > 0 && !stopped {
+		var clen uint32
+		err := binary.Read(r, binary.LittleEndian, &clen)
+		if err != nil {
+			return fmt.Errorf("failed to read index chunk: %w", err)
+		}
+
+		if int64(clen)+4 > size {
+			return fmt.Errorf("index chunk length %d out of range", clen)
+		}
+
+		chunk := make([]byte, clen)
+		_, err = io.ReadFull(r, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to read index chunk: %w", err)
+		}
+
+		size -= 4 + int64(clen)
+
+		records, err := transformer.decrypt(codec, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt index chunk: %w", err)
+		}
+
+		err = readIndexRecords(bytes.NewReader(records), int64(len(records)), func(inum uint64, inode *INode) bool {
+			stopped = !emit(inum, inode)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // crashRecoveryAllIndex parses the regions file collection and restores the in-memory index with the following.
 // Steps:
 // 1. Crash recovery logic scans all data files.
-// 2. Reads the first 26 bytes of MetaInfo from each data record.
+// 2. Reads the first 45 bytes of MetaInfo from each data record.
 // 3. Replays these records and checks whether the DEL value is 1.
 // 4. If DEL is 1, the corresponding entry is deleted from the in-memory index.
 // 5. Otherwise, the disk metadata is reconstructed into the index.
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
-func crashRecoveryAllIndex(regions map[uint64]*os.File, indexs []*indexMap) error {
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
+func (lfs *LogStructuredFS) crashRecoveryAllIndex() error {
+	return lfs.replayRegions(0, uint64(len(dataFileMetadata)))
+}
+
+// errIncompleteSegment is returned for a segment that extends past the end of its region.
+var errIncompleteSegment = errors.New("incomplete segment")
+
+// replayRegions replays, in region order, every segment located at or after
+// fromOffset of the region fromRegion, older regions are skipped entirely.
+//
+// A process killed in the middle of an append leaves a torn segment at the end
+// of the newest written region, it is truncated away and the recovery goes on.
+// Regions are only rotated after a complete append, so a damaged segment anywhere
+// else is real corruption, it fails the recovery unless skipCorrupt is set.
+//
+// Garbage collection copies live segments into regions newer than the ones
+// written meanwhile, so region order is not write order. The newest segment of
+// a key by log sequence number wins, deleted keys are remembered until the end.
+func (lfs *LogStructuredFS) replayRegions(fromRegion, fromOffset uint64) error {
 	var regionIds []uint64
-	for v := range regions {
-		regionIds = append(regionIds, v)
+	for v := range lfs.regions {
+		if v >= fromRegion {
+			regionIds = append(regionIds, v)
+		}
 	}
 
 	sort.Slice(regionIds, func(i, j int) bool {
 		return regionIds[i] < regionIds[j]
 	})
 
+	sizes := make(map[uint64]uint64, len(regionIds))
 	for _, regionId := range regionIds {
-		fd, ok := regions[uint64(regionId)]
-		if !ok {
-			return fmt.Errorf("data file does not exist regions id: %d", regionId)
+		finfo, err := lfs.regions[regionId].Stat()
+		if err != nil {
+			return err
 		}
+		sizes[regionId] = uint64(finfo.Size())
+	}
 
-		finfo, err := fd.Stat()
+	// The newest region holding segments is the only one allowed to have a torn tail,
+	// a fresh empty active region may have been created after it.
+	var tailRegion uint64
+	for _, regionId := range regionIds {
+		if sizes[regionId] > uint64(len(dataFileMetadata)) {
+			tailRegion = regionId
+		}
+	}
+
+	deleted := make(map[string]uint64)
+	for _, regionId := range regionIds {
+		offset := uint64(len(dataFileMetadata))
+		if regionId == fromRegion && fromOffset > offset {
+			offset = fromOffset
+		}
+
+		if offset > sizes[regionId] {
+			return fmt.Errorf("replay offset %d beyond the end of region %d", offset, regionId)
+		}
+
+		err := lfs.replayRegion(regionId, offset, sizes[regionId], regionId == tailRegion, deleted)
 		if err != nil {
 			return err
 		}
+	}
 
-		offset := uint64(len(dataFileMetadata))
+	return nil
+}
 
-		for offset < uint64(finfo.Size()) {
-			inum, segment, err := readSegment(fd, offset, SEGMENT_PADDING)
-			if err != nil {
-				return fmt.Errorf("failed to parse data file segment: %w", err)
-			}
+// replayRegion replays the segments of a region between offset and end into the index.
+// Segments of a write batch are held back until its commit marker is read, a batch
+// without commit marker is discarded as a whole.
+func (lfs *LogStructuredFS) replayRegion(regionId, offset, end uint64, tail bool, deleted map[string]uint64) error {
+	fd, ok := lfs.regions[regionId]
+	if !ok {
+		return fmt.Errorf("data file does not exist regions id: %d", regionId)
+	}
 
-			imap := indexs[inum%uint64(indexShard)]
-			if imap != nil {
-				if segment.IsTombstone() {
-					delete(imap.index, inum)
-					offset += uint64(segment.Size())
-					continue
-				}
+	var batch *replayBatch
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		var segment *Segment
+		if err == nil {
+			// The index needs no values, they are decoded with their own codec when read
+			// and the secret of an encrypted value may be configured only after recovery.
+			segment, err = readRawSegment(fd, offset, SEGMENT_PADDING)
+		}
 
-				if segment.ExpiredAt <= uint64(time.Now().UnixNano()) && segment.ExpiredAt != 0 {
-					offset += uint64(segment.Size())
-					continue
+		if err != nil {
+			// Only the last segment of the tail region can be torn by an interrupted append,
+			// an interrupted batch is truncated back to its begin marker.
+			if tail && (errors.Is(err, errIncompleteSegment) || offset+size == end) {
+				if batch != nil {
+					return lfs.truncateRegion(regionId, batch.offset, end, err)
 				}
+				return lfs.truncateRegion(regionId, offset, end, err)
+			}
 
-				imap.index[inum] = &INode{
-					RegionID:  regionId,
-					Position:  offset,
-					Length:    segment.Size(),
-					CreatedAt: segment.CreatedAt,
-					ExpiredAt: segment.ExpiredAt,
-					mvcc:      0,
-				}
+			if !lfs.skipCorrupt {
+				return fmt.Errorf("corrupted segment in region %d at offset %d: %w", regionId, offset, err)
+			}
 
-				offset += uint64(segment.Size())
-			} else {
-				return errors.New("no corresponding index shard")
+			// Without a trustworthy segment size the next segment can not be located.
+			if errors.Is(err, errIncompleteSegment) {
+				clog.Warnf("skipped corrupted region %d from offset %d to %d: %s", regionId, offset, end, err)
+				return nil
 			}
+
+			clog.Warnf("skipped corrupted segment in region %d at offset %d: %s", regionId, offset, err)
+			offset += size
+			continue
+		}
+
+		// New writes continue after the newest segment, even one of a discarded batch.
+		if segment.LSN > lfs.sequence {
+			lfs.sequence = segment.LSN
+		}
+
+		// A key that can not be decrypted is not corrupted, the secret is missing.
+		err = decodeSegmentKey(segment)
+		if err != nil {
+			return fmt.Errorf("segment in region %d at offset %d: %w", regionId, offset, err)
 		}
 
+		inum := InodeNum(string(segment.Key))
+
+		switch {
+		case segment.Tombstone == batchBegin:
+			if batch != nil {
+				err = lfs.corruptBatch(regionId, batch.offset, errors.New("batch has no commit marker"))
+				if err != nil {
+					return err
+				}
+			}
+			batch = &replayBatch{offset: offset, count: batchCount(segment)}
+		case segment.Tombstone == batchCommit:
+			if batch == nil {
+				err = lfs.corruptBatch(regionId, offset, errors.New("commit marker without batch"))
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if batchCount(segment) != batch.count || uint32(len(batch.entries)) != batch.count {
+				err = lfs.corruptBatch(regionId, batch.offset, errors.New("batch count mismatch"))
+				if err != nil {
+					return err
+				}
+				batch = nil
+				break
+			}
+			for _, entry := range batch.entries {
+				err = lfs.replaySegment(regionId, entry.offset, entry.inum, entry.segment, deleted)
+				if err != nil {
+					return err
+				}
+			}
+			batch = nil
+		case batch != nil:
+			batch.entries = append(batch.entries, replayEntry{offset: offset, inum: inum, segment: segment})
+		default:
+			err = lfs.replaySegment(regionId, offset, inum, segment, deleted)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += uint64(segment.Size())
+	}
+
+	// The append of a batch was interrupted right at a segment boundary.
+	if batch != nil {
+		if tail {
+			return lfs.truncateRegion(regionId, batch.offset, end, errors.New("batch has no commit marker"))
+		}
+		return lfs.corruptBatch(regionId, batch.offset, errors.New("batch has no commit marker"))
+	}
+
+	return nil
+}
+
+// replaySegment applies a segment read during recovery to the index, unless the
+// key has a newer version or deletion. deleted holds the LSN of the deletion of keys.
+func (lfs *LogStructuredFS) replaySegment(regionId, offset, inum uint64, segment *Segment, deleted map[string]uint64) error {
+	imap := lfs.indexs[inum%uint64(indexShard)]
+	if imap == nil {
+		return errors.New("no corresponding index shard")
+	}
+
+	key := string(segment.Key)
+	if deletedAt, ok := deleted[key]; ok && segment.LSN < deletedAt {
+		return nil
+	}
+
+	if inode, ok := imap.lookup(inum, key); ok && segment.LSN < inode.LSN {
+		return nil
+	}
+
+	// An expired newest version deletes the key just like a tombstone.
+	if segment.IsTombstone() || (segment.ExpiredAt <= uint64(time.Now().UnixNano()) && segment.ExpiredAt != 0) {
+		imap.remove(inum, key)
+		deleted[key] = segment.LSN
+		return nil
+	}
+
+	imap.insert(inum, &INode{
+		RegionID:   regionId,
+		Position:   offset,
+		Length:     segment.Size(),
+		CreatedAt:  segment.CreatedAt,
+		ExpiredAt:  segment.ExpiredAt,
+		Key:        key,
+		SlidingTTL: segment.SlidingTTL,
+		LSN:        segment.LSN,
+	})
+
+	return nil
+}
+
+// corruptBatch reports a damaged batch, it is only discarded if corrupted segments may be skipped.
+func (lfs *LogStructuredFS) corruptBatch(regionId, offset uint64, cause error) error {
+	if !lfs.skipCorrupt {
+		return fmt.Errorf("corrupted batch in region %d at offset %d: %w", regionId, offset, cause)
+	}
+	clog.Warnf("discarded corrupted batch in region %d at offset %d: %s", regionId, offset, cause)
+	return nil
+}
+
+// truncateRegion discards the torn tail of a region starting at offset.
+func (lfs *LogStructuredFS) truncateRegion(regionId, offset, end uint64, cause error) error {
+	fd := lfs.regions[regionId]
+
+	err := fd.Truncate(int64(offset))
+	if err != nil {
+		return fmt.Errorf("failed to truncate torn segment of region %d: %w", regionId, err)
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync truncated region %d: %w", regionId, err)
+	}
+
+	// Appends continue right after the last valid segment.
+	if fd == lfs.active {
+		_, err = fd.Seek(int64(offset), io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to seek truncated region %d: %w", regionId, err)
+		}
+		lfs.offset = offset
 	}
 
+	clog.Warnf("discarded %d bytes of torn segment in region %d at offset %d: %s", end-offset, regionId, offset, cause)
+
 	return nil
 }
 
-func validateFileHeader(file *os.File) error {
+// segmentSizeAt returns the size of the segment at offset from its header,
+// errIncompleteSegment is returned if the segment does not end before end.
+func segmentSizeAt(fd *os.File, offset, end uint64) (uint64, error) {
+	return segmentSize(fd, offset, end, SEGMENT_PADDING)
+}
+
+// segmentSize is segmentSizeAt for a region format with headers of padding bytes.
+func segmentSize(fd *os.File, offset, end uint64, padding int64) (uint64, error) {
+	if offset+uint64(padding) > end {
+		return end - offset, errIncompleteSegment
+	}
+
+	header := make([]byte, padding)
+	_, err := fd.ReadAt(header, int64(offset))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read segment header: %w", err)
+	}
+
+	// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | ...
+	// Key and value sizes are at the same position in every format version.
+	size := uint64(padding) + uint64(binary.LittleEndian.Uint32(header[18:22])) +
+		uint64(binary.LittleEndian.Uint32(header[22:26])) + 4
+	if offset+size > end {
+		return size, errIncompleteSegment
+	}
+
+	return size, nil
+}
+
+func validateFileHeader(file *os.File, metadata []byte) error {
 	var fileHeader [4]byte
-	n, err := file.Read(fileHeader[:])
+	n, err := file.ReadAt(fileHeader[:], 0)
 	if err != nil {
 		return err
 	}
 
-	if n != len(dataFileMetadata) {
+	if n != len(metadata) {
 		return errors.New("file is too short to contain valid signature")
 	}
 
-	if !bytes.Equal(fileHeader[:], dataFileMetadata[:]) {
+	if !bytes.Equal(fileHeader[:], metadata[:]) {
 		return fmt.Errorf("unsupported data file version: %v", file.Name())
 	}
 
 	return nil
 }
 
+// regionVersion returns the format version from the header of a region file.
+func regionVersion(file *os.File) (uint8, error) {
+	var fileHeader [4]byte
+	_, err := file.ReadAt(fileHeader[:], 0)
+	if err != nil {
+		return 0, fmt.Errorf("file is too short to contain valid signature: %w", err)
+	}
+
+	if !bytes.Equal(fileHeader[:3], dataFileMetadata[:3]) {
+		return 0, fmt.Errorf("invalid data file signature: %v", file.Name())
+	}
+
+	version := fileHeader[3]
+	if _, ok := segmentHeaderSizes[version]; !ok {
+		return 0, fmt.Errorf("unsupported data file version %d: %v", version, file.Name())
+	}
+
+	return version, nil
+}
+
 func checkFileSystem(path string) error {
 	if !utils.IsExist(path) {
 		err := os.MkdirAll(path, fsPerm)
@@ -791,23 +1673,15 @@ func checkFileSystem(path string) error {
 					}
 					defer file.Close()
 
-					err = validateFileHeader(file)
+					version, err := regionVersion(file)
 					if err != nil {
 						return fmt.Errorf("failed to validated data file header: %w", err)
 					}
-				}
-			}
-
-			if !file.IsDir() && file.Name() == indexFileName {
-				file, err := os.Open(filepath.Join(path, file.Name()))
-				if err != nil {
-					return fmt.Errorf("failed to check index file: %w", err)
-				}
-				defer file.Close()
 
-				err = validateFileHeader(file)
-				if err != nil {
-					return fmt.Errorf("failed to validated index file header: %w", err)
+					if version < FormatVersion {
+						return fmt.Errorf("data file %s has format version %d, run wiredb upgrade --path %s: %w",
+							file.Name(), version, path, ErrOutdatedFormat)
+					}
 				}
 			}
 		}
@@ -816,13 +1690,100 @@ func checkFileSystem(path string) error {
 	return nil
 }
 
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+// readSegment reads and decodes the segment at offset, bufsize is the header size
+// of the region format version, see segmentHeaderSizes.
 func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, error) {
+	seg, err := readRawSegment(fd, offset, bufsize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = decodeSegmentKey(seg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Tombstones and batch markers carry no encoded value.
+	if seg.Tombstone != 0 {
+		return InodeNum(string(seg.Key)), seg, nil
+	}
+
+	// Update Segment data fields with the read valuebuf and process it through Transformer before use
+	decodedData, err := transformer.Decode(seg.Codec, seg.Value)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to transformer decode value in segment: %w", err)
+	}
+	seg.Value = decodedData
+
+	return InodeNum(string(seg.Key)), seg, nil
+}
+
+// headerCodec returns the codec recorded in the header of a raw segment.
+func headerCodec(header []byte) Codec {
+	return Codec{
+		Compressor: header[38],
+		Encryptor:  header[39],
+		KeyID:      binary.LittleEndian.Uint32(header[40:44]),
+		Flags:      header[44],
+	}
+}
+
+// encodeSegmentKey encrypts the key of seg before it is appended if key encryption
+// is enabled, a segment whose key is already encrypted is left as is.
+func encodeSegmentKey(seg *Segment) error {
+	if seg.Codec.Flags&CodecEncryptedKey != 0 {
+		return nil
+	}
+
+	// The codec has room for one secret, the key can not be encrypted without the value.
+	if _, ok := transformer.keyCodec(); ok && seg.Tombstone == 0 && seg.Codec.Encryptor == CodecNone {
+		return errors.New("failed to encrypt segment key: value was encoded without encryption")
+	}
+
+	key, codec, err := transformer.EncodeKey(seg.Key, seg.Codec)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt segment key: %w", err)
+	}
+	seg.Key, seg.KeySize, seg.Codec = key, uint32(len(key)), codec
+
+	return nil
+}
+
+// decodeSegmentKey decrypts the key of a segment read from a region, KeySize keeps
+// the size of the key as stored.
+func decodeSegmentKey(seg *Segment) error {
+	key, err := transformer.DecodeKey(seg.Codec, seg.Key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment key: %w", err)
+	}
+	seg.Key = key
+	return nil
+}
+
+// readSegmentKey reads and decrypts the key of the segment at offset, header is its header.
+func readSegmentKey(fd *os.File, offset uint64, header []byte) (string, error) {
+	key := make([]byte, binary.LittleEndian.Uint32(header[18:22]))
+	_, err := fd.ReadAt(key, int64(offset)+SEGMENT_PADDING)
+	if err != nil {
+		return "", err
+	}
+
+	key, err = transformer.DecodeKey(headerCodec(header), key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt segment key: %w", err)
+	}
+	return string(key), nil
+}
+
+// readRawSegment reads and verifies the segment at offset without decoding its value.
+// Fields missing in older format versions are left zero:
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
+func readRawSegment(fd *os.File, offset uint64, bufsize int64) (*Segment, error) {
 	buf := make([]byte, bufsize)
 
 	_, err := fd.ReadAt(buf, int64(offset))
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
 	var seg Segment
@@ -852,13 +1813,39 @@ func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, e
 	seg.ValueSize = binary.LittleEndian.Uint32(buf[readOffset : readOffset+4])
 	readOffset += 4
 
-	// End of Header 26 bytes
+	// Parse SlidingTTL (4 bytes), since format version 2
+	if int64(readOffset+4) <= bufsize {
+		seg.SlidingTTL = binary.LittleEndian.Uint32(buf[readOffset : readOffset+4])
+		readOffset += 4
+	}
+
+	// Parse LSN (8 bytes), since format version 3
+	if int64(readOffset+8) <= bufsize {
+		seg.LSN = binary.LittleEndian.Uint64(buf[readOffset : readOffset+8])
+		readOffset += 8
+	}
+
+	// Parse Codec (6 bytes), since format version 4
+	if int64(readOffset+6) <= bufsize {
+		seg.Codec.Compressor = buf[readOffset]
+		seg.Codec.Encryptor = buf[readOffset+1]
+		seg.Codec.KeyID = binary.LittleEndian.Uint32(buf[readOffset+2 : readOffset+6])
+		readOffset += 6
+	}
+
+	// Parse Flags (1 byte), since format version 5
+	if int64(readOffset+1) <= bufsize {
+		seg.Codec.Flags = buf[readOffset]
+		readOffset++
+	}
+
+	// End of Header 45 bytes in the current format
 
 	// Read Key data
 	keybuf := make([]byte, seg.KeySize)
 	_, err = fd.ReadAt(keybuf, int64(offset)+int64(readOffset))
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to parse key in segment: %w", err)
+		return nil, fmt.Errorf("failed to parse key in segment: %w", err)
 	}
 	readOffset += int(seg.KeySize)
 
@@ -866,7 +1853,7 @@ func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, e
 	valuebuf := make([]byte, seg.ValueSize)
 	_, err = fd.ReadAt(valuebuf, int64(offset)+int64(readOffset))
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to parse value in segment: %w", err)
+		return nil, fmt.Errorf("failed to parse value in segment: %w", err)
 	}
 	readOffset += int(seg.ValueSize)
 
@@ -874,7 +1861,7 @@ func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, e
 	checksumBuf := make([]byte, 4)
 	_, err = fd.ReadAt(checksumBuf, int64(offset)+int64(readOffset))
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to read checksum in segment: %w", err)
+		return nil, fmt.Errorf("failed to read checksum in segment: %w", err)
 	}
 
 	// Verify checksum
@@ -884,19 +1871,13 @@ func readSegment(fd *os.File, offset uint64, bufsize int64) (uint64, *Segment, e
 	buf = append(buf, valuebuf...)
 
 	if checksum != crc32.ChecksumIEEE(buf) {
-		return 0, nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
-	}
-
-	// Update Segment data fields with the read valuebuf and process it through Transformer before use
-	decodedData, err := transformer.Decode(valuebuf)
-	if err != nil {
-		return 0, nil, fmt.Errorf("failed to transformer decode value in segment: %w", err)
+		return nil, fmt.Errorf("failed to crc32 checksum mismatch: %d", checksum)
 	}
 
 	seg.Key = keybuf
-	seg.Value = decodedData
+	seg.Value = valuebuf
 
-	return InodeNum(string(keybuf)), &seg, nil
+	return &seg, nil
 }
 
 func generateFileName(regionID uint64) (string, error) {
@@ -931,7 +1912,7 @@ func formatDataFileName(number uint64) string {
 }
 
 // serializedIndex serializes the index to a recoverable file snapshot record format:
-// | INUM 8 | RID 8  | POS 8 | LEN 4 | EAT 8 | CAT 8 | CRC32 4 |
+// | INUM 8 | RID 8  | POS 8 | LEN 4 | EAT 8 | CAT 8 | SLD 4 | LSN 8 | KLEN 4 | KEY ? | CRC32 4 |
 func serializedIndex(inum uint64, inode *INode) ([]byte, error) {
 	// Create a byte buffer
 	buf := new(bytes.Buffer)
@@ -941,8 +1922,12 @@ func serializedIndex(inum uint64, inode *INode) ([]byte, error) {
 	binary.Write(buf, binary.LittleEndian, inode.RegionID)
 	binary.Write(buf, binary.LittleEndian, inode.Position)
 	binary.Write(buf, binary.LittleEndian, inode.Length)
-	binary.Write(buf, binary.LittleEndian, inode.ExpiredAt)
+	binary.Write(buf, binary.LittleEndian, atomic.LoadUint64(&inode.ExpiredAt))
 	binary.Write(buf, binary.LittleEndian, inode.CreatedAt)
+	binary.Write(buf, binary.LittleEndian, inode.SlidingTTL)
+	binary.Write(buf, binary.LittleEndian, atomic.LoadUint64(&inode.LSN))
+	binary.Write(buf, binary.LittleEndian, uint32(len(inode.Key)))
+	buf.WriteString(inode.Key)
 
 	// Calculate CRC32 checksum
 	checksum := crc32.ChecksumIEEE(buf.Bytes())
@@ -955,7 +1940,7 @@ func serializedIndex(inum uint64, inode *INode) ([]byte, error) {
 }
 
 // deserializedIndex restores the index file snapshot to an in-memory struct:
-// | INUM 8 | RID 8  | OFS 8 | LEN 4 | EAT 8 | CAT 8 | CRC32 4 |
+// | INUM 8 | RID 8  | OFS 8 | LEN 4 | EAT 8 | CAT 8 | SLD 4 | LSN 8 | KLEN 4 | KEY ? | CRC32 4 |
 func deserializedIndex(data []byte) (uint64, *INode, error) {
 	buf := bytes.NewReader(data)
 	var inum uint64
@@ -991,6 +1976,33 @@ func deserializedIndex(data []byte) (uint64, *INode, error) {
 		return 0, nil, err
 	}
 
+	err = binary.Read(buf, binary.LittleEndian, &inode.SlidingTTL)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = binary.Read(buf, binary.LittleEndian, &inode.LSN)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var klen uint32
+	err = binary.Read(buf, binary.LittleEndian, &klen)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if int(klen) > buf.Len()-4 {
+		return 0, nil, fmt.Errorf("index key length %d out of range", klen)
+	}
+
+	key := make([]byte, klen)
+	_, err = io.ReadFull(buf, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	inode.Key = string(key)
+
 	// Deserialize and verify CRC32 checksum
 	var checksum uint32
 	err = binary.Read(buf, binary.LittleEndian, &checksum)
@@ -1039,6 +2051,21 @@ func serializedSegment(seg *Segment) ([]byte, error) {
 		return nil, fmt.Errorf("failed to write ValueSize: %w", err)
 	}
 
+	err = binary.Write(buf, binary.LittleEndian, seg.SlidingTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write SlidingTTL: %w", err)
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, seg.LSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write LSN: %w", err)
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, seg.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write Codec: %w", err)
+	}
+
 	err = binary.Write(buf, binary.LittleEndian, seg.Key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write Key: %w", err)
@@ -1070,120 +2097,6 @@ func serializedSegment(seg *Segment) ([]byte, error) {
 // 7. Note: The key point is reverse scanning. Use keys from the disk data files to locate and compare records in memory.
 // 8. If the in-memory index is used to locate records, it becomes impossible to determine if a file has been fully scanned.
 // 9. This is because records in the in-memory index may be distributed across multiple data files on disk.
-func (lfs *LogStructuredFS) cleanupDirtyRegion() error {
-	lfs.mu.Lock()
-	defer lfs.mu.Unlock()
-
-	// 修改 GC 的状态为运行状态
-	lfs.gcstate = GC_ACTIVE
-
-	if len(lfs.regions) >= 5 {
-		var regionIds []uint64
-		for v := range lfs.regions {
-			regionIds = append(regionIds, v)
-		}
-		sort.Slice(regionIds, func(i, j int) bool {
-			return regionIds[i] < regionIds[j]
-		})
-
-		// find 40% dirty region
-		for i := 0; i < 4 && i < len(regionIds); i++ {
-			lfs.dirtyRegion = append(lfs.dirtyRegion, lfs.regions[regionIds[i]])
-		}
-
-		// Cleanup dirty region
-		defer func() {
-			lfs.dirtyRegion = nil
-		}()
-
-		for _, fd := range lfs.dirtyRegion {
-			finfo, err := fd.Stat()
-			if err != nil {
-				return err
-			}
-
-			readOffset := uint64(len(dataFileMetadata))
-
-			for readOffset < uint64(finfo.Size()) {
-				inum, segment, err := readSegment(fd, uint64(readOffset), SEGMENT_PADDING)
-				if err != nil {
-					return err
-				}
-
-				imap := lfs.indexs[inum%uint64(indexShard)]
-				if imap != nil {
-					imap.mu.RLock()
-					inode, ok := imap.index[inum]
-					imap.mu.RUnlock()
-
-					if !ok {
-						continue
-					}
-
-					if isValid(&imap.mu, segment, inode) {
-						bytes, err := serializedSegment(segment)
-						if err != nil {
-							return err
-						}
-
-						lfs.mu.Lock()
-						err = appendToActiveRegion(lfs.active, bytes)
-						lfs.mu.Unlock()
-						if err != nil {
-							return err
-						}
-
-						lfs.mu.Lock()
-						delete(lfs.regions, inode.RegionID)
-						lfs.mu.Unlock()
-
-						atomic.AddUint64(&inode.Position, atomic.LoadUint64(&lfs.offset))
-						atomic.AddUint64(&inode.RegionID, atomic.LoadUint64(&lfs.regionID))
-
-						atomic.AddUint64(&lfs.offset, uint64(segment.Size()))
-
-						readOffset += uint64(segment.Size())
-					} else {
-						// next segment
-						continue
-					}
-
-				} else {
-					return fmt.Errorf("imap is nil for inum = %d", inum)
-				}
-
-				if atomic.LoadUint64(&lfs.offset) >= uint64(regionThreshold) {
-					err := lfs.changeRegions()
-					if err != nil {
-						return fmt.Errorf("failed to close active migrate region: %w", err)
-					}
-				}
-
-				// Delete dirty region file
-				lfs.mu.Lock()
-				err = os.Remove(filepath.Join(lfs.directory, fd.Name()))
-				lfs.mu.Unlock()
-				if err != nil {
-					return fmt.Errorf("failed to remove dirty region: %w", err)
-				}
-			}
-
-		}
-	} else {
-		clog.Warnf("dirty region (%d%%) does not meet garbage collection status", len(lfs.regions)/10)
-	}
-
-	return nil
-}
-
-func isValid(mu *sync.RWMutex, seg *Segment, inode *INode) bool {
-	mu.Lock()
-	defer mu.Unlock()
-	return !seg.IsTombstone() &&
-		seg.CreatedAt == inode.CreatedAt &&
-		(seg.ExpiredAt == 0 || uint64(time.Now().Unix()) < seg.ExpiredAt)
-}
-
 // Start serializing little-endian data, needs to compress seg before writing.
 func appendToActiveRegion(fd *os.File, bytes []byte) error {
 	// Write the byte stream to the file
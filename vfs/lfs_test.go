@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -23,10 +24,11 @@ func TestSerializedIndex(t *testing.T) {
 		Length:    100,
 		ExpiredAt: 1617181723,
 		CreatedAt: 1617181623,
+		Key:       "mock-key",
 	}
 
-	// 计算预期的字节切片
-	expectedLength := 48
+	// 计算预期的字节切片，固定部分 INDEX_PADDING 字节 + KEY + CRC32 4 字节
+	expectedLength := INDEX_PADDING + len(inode.Key) + 4
 
 	// 调用 serializeIndex
 	result, err := serializedIndex(1001, inode)
@@ -65,6 +67,9 @@ func TestSerializedIndex(t *testing.T) {
 	if node.CreatedAt != inode.CreatedAt {
 		t.Errorf("expected CreatedAt %d, got %d", inode.CreatedAt, node.CreatedAt)
 	}
+	if node.Key != inode.Key {
+		t.Errorf("expected Key %s, got %s", inode.Key, node.Key)
+	}
 
 }
 
@@ -103,7 +108,7 @@ func TestReadSegment(t *testing.T) {
 
 	// 使用 readSegment 读取并测试数据
 	offset := uint64(0)
-	inum, segment, err := readSegment(tmpFile, offset, 26)
+	inum, segment, err := readSegment(tmpFile, offset, SEGMENT_PADDING)
 	if err != nil {
 		t.Fatalf("expected no error, but got: %v", err)
 	}
@@ -436,9 +441,10 @@ func TestConcurrentPutAndFetchSegment(t *testing.T) {
 }
 
 func TestVFSOpertions(t *testing.T) {
+	// 使用独立的目录，避免统计到其他测试写入 conf.Settings.Path 的数据
 	fss, err := OpenFS(&Options{
 		FSPerm:    conf.FSPerm,
-		Path:      conf.Settings.Path,
+		Path:      t.TempDir(),
 		Threshold: conf.Settings.Region.Threshold,
 	})
 	assert.NoError(t, err)
@@ -481,7 +487,8 @@ func TestVFSOpertions(t *testing.T) {
 	assert.NoError(t, err)
 
 	_, _, err = fss.FetchSegment("key-01")
-	assert.Equal(t, err.Error(), "inode index for 9171687345308829835 not found")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Equal(t, err.Error(), "key not found: inode index for 9171687345308829835 not found")
 
 	err = fss.ExportSnapshotIndex()
 	assert.NoError(t, err)
@@ -495,3 +502,350 @@ func TestVFSOpertions(t *testing.T) {
 
 	os.RemoveAll(conf.Settings.Path)
 }
+
+func TestKeysWithSnapshotRecovery(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"user:1", "user:2", "order:1"} {
+		seg, err := NewSegment(key, types.NewNumber(1), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	assert.NoError(t, fss.DeleteSegment("user:2"))
+
+	assert.ElementsMatch(t, []string{"user:1", "order:1"}, fss.Keys(""))
+	assert.ElementsMatch(t, []string{"user:1"}, fss.Keys("user:"))
+
+	// 中途停止遍历
+	visited := 0
+	fss.RangeKeys("", func(key string) bool {
+		visited++
+		return false
+	})
+	assert.Equal(t, 1, visited)
+
+	assert.NoError(t, fss.CloseFS())
+
+	// 重新打开之后从 index.wdb 快照恢复出原始的 key
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user:1", "order:1"}, fss.Keys(""))
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestIndexMapCollisionChain(t *testing.T) {
+	imap := &indexMap{index: make(map[uint64]*INode)}
+
+	// 模拟三个 inode number 相同的不同 key
+	imap.insert(42, &INode{Key: "a", Position: 1})
+	imap.insert(42, &INode{Key: "b", Position: 2})
+	imap.insert(42, &INode{Key: "c", Position: 3})
+	assert.Equal(t, 3, imap.size)
+
+	for i, key := range []string{"a", "b", "c"} {
+		inode, ok := imap.lookup(42, key)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i+1), inode.Position)
+	}
+
+	// 替换链表中间的节点不会影响其他 key
+	imap.insert(42, &INode{Key: "b", Position: 20})
+	assert.Equal(t, 3, imap.size)
+	inode, ok := imap.lookup(42, "b")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(20), inode.Position)
+
+	_, ok = imap.remove(42, "c")
+	assert.True(t, ok)
+	_, ok = imap.lookup(42, "c")
+	assert.False(t, ok)
+
+	_, ok = imap.remove(42, "x")
+	assert.False(t, ok)
+
+	_, ok = imap.remove(42, "a")
+	assert.True(t, ok)
+	_, ok = imap.remove(42, "b")
+	assert.True(t, ok)
+	assert.Equal(t, 0, imap.size)
+	assert.Empty(t, imap.index)
+}
+
+func TestFetchSegmentVerifiesKey(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("key-a", types.NewNumber(1), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("key-a", seg))
+
+	// 伪造一个指向 key-a 数据的 key-b 索引，模拟哈希冲突导致的错误指向
+	inum := InodeNum("key-a")
+	imap := fss.indexs[inum%uint64(indexShard)]
+	inode, ok := imap.lookup(inum, "key-a")
+	assert.True(t, ok)
+
+	forged := InodeNum("key-b")
+	fmap := fss.indexs[forged%uint64(indexShard)]
+	fmap.insert(forged, &INode{
+		RegionID: inode.RegionID,
+		Position: inode.Position,
+		Length:   inode.Length,
+		Key:      "key-b",
+	})
+
+	_, _, err = fss.FetchSegment("key-b")
+	assert.Error(t, err)
+
+	_, seg, err = fss.FetchSegment("key-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "key-a", string(seg.Key))
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestReplayAfterStaleSnapshot(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	put := func(key string, n int64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("key-1", 1)
+	put("key-2", 2)
+	assert.NoError(t, fss.ExportSnapshotIndex())
+
+	// 快照之后的写入，模拟进程被强制杀死没有正常关闭
+	put("key-1", 10)
+	put("key-3", 3)
+	assert.NoError(t, fss.DeleteSegment("key-2"))
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key-1", "key-3"}, recovered.Keys(""))
+
+	_, seg, err := recovered.FetchSegment("key-1")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), number.Value)
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestCorruptedSnapshotFallback(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		seg, err := NewSegment(key, types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	assert.NoError(t, fss.CloseFS())
+
+	// 导出快照时使用的临时文件不应该残留
+	assert.NoFileExists(t, filepath.Join(opt.Path, indexFileName+".tmp"))
+
+	snapshot := filepath.Join(opt.Path, indexFileName)
+	data, err := os.ReadFile(snapshot)
+	assert.NoError(t, err)
+
+	corruptions := map[string][]byte{
+		// 写了一半的快照文件
+		"truncated": data[:len(data)/2],
+		// 记录内容被篡改
+		"flipped": append(append([]byte{}, data[:INDEX_HEADER]...), append([]byte{data[INDEX_HEADER] ^ 0xFF}, data[INDEX_HEADER+1:]...)...),
+		// 只有文件头
+		"header": data[:4],
+	}
+
+	for name, corrupted := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, os.WriteFile(snapshot, corrupted, conf.FSPerm))
+
+			recovered, err := OpenFS(opt)
+			assert.NoError(t, err)
+			assert.Equal(t, 10, recovered.KeysCount())
+			assert.NoError(t, recovered.CloseFS())
+		})
+	}
+}
+
+func TestRecoveryTruncatesTornTail(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+	valid := fss.offset
+
+	// 模拟追加写入到一半时进程崩溃，只写入了最后一个数据段的一部分
+	seg, err := NewSegment("key-torn", types.NewNumber(99), 0)
+	assert.NoError(t, err)
+	bytes, err := serializedSegment(seg)
+	assert.NoError(t, err)
+	_, err = fss.active.Write(bytes[:len(bytes)/2])
+	assert.NoError(t, err)
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key-0", "key-1", "key-2"}, recovered.Keys(""))
+	assert.Equal(t, valid, recovered.offset)
+
+	stat, err := recovered.active.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(valid), stat.Size())
+
+	// 截断之后继续追加的数据能被正常读取
+	seg, err = NewSegment("key-3", types.NewNumber(3), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, recovered.PutSegment("key-3", seg))
+	_, seg, err = recovered.FetchSegment("key-3")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), number.Value)
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestRecoveryCorruptSegment(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	var position uint64
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			position = fss.offset
+		}
+		seg, err := NewSegment(fmt.Sprintf("key-%d", i), types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(fmt.Sprintf("key-%d", i), seg))
+	}
+
+	// 破坏中间数据段的校验码，它后面还有完整的数据段，不属于写入撕裂
+	fd, err := os.OpenFile(fss.active.Name(), os.O_RDWR, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xFF}, int64(position)+SEGMENT_PADDING)
+	assert.NoError(t, err)
+	assert.NoError(t, fd.Close())
+
+	_, err = OpenFS(opt)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf("corrupted segment in region %d at offset %d", fss.regionID, position))
+	}
+
+	opt.RecoverSkipCorrupt = true
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"key-0", "key-2"}, recovered.Keys(""))
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestRecoveryOrderByLSN(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	put := func(fss *LogStructuredFS, key string, n int64, createdAt uint64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		seg.CreatedAt = createdAt
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 时钟回拨或者时间戳相同的时候，后写入的数据依然是最新版本
+	put(fss, "key", 0, 300)
+	put(fss, "key", 1, 200)
+	put(fss, "key", 2, 200)
+	put(fss, "gone", 0, 500)
+	assert.NoError(t, fss.DeleteSegment("gone"))
+
+	version, _, err := fss.FetchSegment("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), version)
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	version, seg, err := recovered.FetchSegment("key")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), number.Value)
+	assert.Equal(t, uint64(3), version)
+	_, _, err = recovered.FetchSegment("gone")
+	assert.Error(t, err)
+
+	// 重启之后的序列号接着之前最大的序列号递增，版本号在重启前后保持一致
+	assert.Equal(t, uint64(5), recovered.sequence)
+	seg, err = NewSegment("key", types.NewNumber(3), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, recovered.UpdateSegmentWithCAS("key", version, seg))
+	version, _, err = recovered.FetchSegment("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), version)
+	assert.NoError(t, recovered.CloseFS())
+
+	recovered, err = OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), recovered.sequence)
+	version, _, err = recovered.FetchSegment("key")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), version)
+	assert.NoError(t, recovered.CloseFS())
+}
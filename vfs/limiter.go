@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"sync"
+	"time"
+)
+
+// maxThrottleSleep bounds a single sleep of the limiter, so a changed rate
+// takes effect quickly even while a large segment is being throttled.
+const maxThrottleSleep = 100 * time.Millisecond
+
+// rateLimiter is a token bucket of bytes that refills at rate bytes per second
+// and holds at most one second of budget. A rate of 0 disables throttling.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// setRate changes the budget, waiters pick it up within maxThrottleSleep.
+func (rl *rateLimiter) setRate(rate uint64) {
+	rl.mu.Lock()
+	rl.refill()
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+	rl.mu.Unlock()
+}
+
+func (rl *rateLimiter) getRate() uint64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate
+}
+
+func (rl *rateLimiter) refill() {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+	if rl.tokens > float64(rl.rate) {
+		rl.tokens = float64(rl.rate)
+	}
+	rl.last = now
+}
+
+// wait takes n bytes from the budget and blocks until it is no longer
+// overdrawn. It returns how long the caller was throttled.
+func (rl *rateLimiter) wait(n uint64) time.Duration {
+	start := time.Now()
+
+	rl.mu.Lock()
+	if rl.rate == 0 {
+		rl.mu.Unlock()
+		return 0
+	}
+	rl.refill()
+	rl.tokens -= float64(n)
+
+	for rl.tokens < 0 {
+		if rl.rate == 0 {
+			rl.tokens = 0
+			break
+		}
+
+		sleep := time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+		if sleep > maxThrottleSleep {
+			sleep = maxThrottleSleep
+		}
+		rl.mu.Unlock()
+		time.Sleep(sleep)
+		rl.mu.Lock()
+		rl.refill()
+	}
+	rl.mu.Unlock()
+
+	return time.Since(start)
+}
@@ -0,0 +1,29 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 不限速时不会等待
+	rl := newRateLimiter(0)
+	assert.Equal(t, time.Duration(0), rl.wait(1<<30))
+
+	// 初始有一秒的预算，超出的部分按照速率等待
+	rl = newRateLimiter(1 * MB)
+	assert.Less(t, rl.wait(1*MB), 50*time.Millisecond)
+	throttled := rl.wait(200 * KB)
+	assert.GreaterOrEqual(t, throttled, 150*time.Millisecond)
+	assert.Less(t, throttled, time.Second)
+
+	// 运行时取消限速，正在等待的调用很快返回
+	done := make(chan time.Duration)
+	go func() { done <- rl.wait(10 * MB) }()
+	time.Sleep(50 * time.Millisecond)
+	rl.setRate(0)
+	assert.Less(t, <-done, time.Second)
+	assert.Equal(t, uint64(0), rl.getRate())
+}
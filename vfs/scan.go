@@ -0,0 +1,219 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/auula/wiredkv/utils"
+)
+
+const (
+	DefaultScanCount = 10
+	MaxScanCount     = 1000
+)
+
+// ScanOptions filters the keys returned by Scan.
+type ScanOptions struct {
+	Prefix string // Only keys starting with Prefix are returned
+	Match  string // Glob pattern the keys must match, empty matches all
+	Kinds  []Kind // Only keys of these types are returned, empty returns all types
+	Count  int    // Maximum number of keys in a page
+}
+
+// scanCursor is the decoded form of the opaque cursor returned by Scan.
+// The index is walked shard by shard in ascending inode number order,
+// the cursor records the shard and the last inode number returned.
+type scanCursor struct {
+	shard uint32
+	inum  uint64
+	after bool // inum is valid, only inode numbers greater than it are left
+}
+
+func (c scanCursor) encode() string {
+	buf := make([]byte, 13)
+	binary.LittleEndian.PutUint32(buf[0:4], c.shard)
+	binary.LittleEndian.PutUint64(buf[4:12], c.inum)
+	if c.after {
+		buf[12] = 1
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeScanCursor(cursor string) (scanCursor, error) {
+	if cursor == "" {
+		return scanCursor{}, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != 13 {
+		return scanCursor{}, errors.New("invalid scan cursor")
+	}
+
+	return scanCursor{
+		shard: binary.LittleEndian.Uint32(buf[0:4]),
+		inum:  binary.LittleEndian.Uint64(buf[4:12]),
+		after: buf[12] == 1,
+	}, nil
+}
+
+type scanEntry struct {
+	inum     uint64
+	key      string
+	regionID uint64
+	position uint64
+}
+
+// Scan returns a page of keys starting at cursor and the cursor of the next page.
+// An empty cursor starts a new iteration and an empty next cursor means the
+// iteration is complete. Keys that exist during the whole iteration are returned
+// at least once, keys written or deleted meanwhile may or may not be returned.
+// A shard is only read locked while its matching entries are copied, so writers
+// are never blocked for the duration of the whole scan.
+func (lfs *LogStructuredFS) Scan(cursor string, opt *ScanOptions) (string, []string, error) {
+	cur, err := decodeScanCursor(cursor)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if int(cur.shard) >= len(lfs.indexs) {
+		return "", nil, fmt.Errorf("scan cursor shard %d out of range", cur.shard)
+	}
+
+	count := opt.Count
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	if count > MaxScanCount {
+		count = MaxScanCount
+	}
+
+	var keys []string
+	for shard := int(cur.shard); shard < len(lfs.indexs); shard++ {
+		entries := lfs.collectScanEntries(lfs.indexs[shard], cur, opt)
+
+		for i := 0; i < len(entries); i++ {
+			// Keys sharing an inode number are never split across pages,
+			// otherwise the cursor could not tell where to resume.
+			if i > 0 && len(keys) >= count && entries[i].inum != entries[i-1].inum {
+				next := scanCursor{shard: uint32(shard), inum: entries[i-1].inum, after: true}
+				return next.encode(), keys, nil
+			}
+
+			ok, err := lfs.matchScanKinds(entries[i], opt.Kinds)
+			if err != nil {
+				return "", nil, err
+			}
+			if ok {
+				keys = append(keys, entries[i].key)
+			}
+		}
+
+		cur = scanCursor{}
+		if len(keys) >= count && shard+1 < len(lfs.indexs) {
+			next := scanCursor{shard: uint32(shard + 1)}
+			return next.encode(), keys, nil
+		}
+	}
+
+	return "", keys, nil
+}
+
+// collectScanEntries copies the entries of a shard that are behind the cursor
+// and match the key filters, sorted by inode number and key.
+func (lfs *LogStructuredFS) collectScanEntries(imap *indexMap, cur scanCursor, opt *ScanOptions) []scanEntry {
+	now := uint64(time.Now().UnixNano())
+	var entries []scanEntry
+
+	imap.mu.RLock()
+	imap.rangeNodes(func(inum uint64, inode *INode) bool {
+		if cur.after && inum <= cur.inum {
+			return true
+		}
+
+		expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+		if expiredAt != 0 && expiredAt <= now {
+			return true
+		}
+
+		if !strings.HasPrefix(inode.Key, opt.Prefix) {
+			return true
+		}
+
+		if opt.Match != "" && !utils.GlobMatch(opt.Match, inode.Key) {
+			return true
+		}
+
+		entries = append(entries, scanEntry{
+			inum:     inum,
+			key:      inode.Key,
+			regionID: atomic.LoadUint64(&inode.RegionID),
+			position: atomic.LoadUint64(&inode.Position),
+		})
+		return true
+	})
+	imap.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].inum != entries[j].inum {
+			return entries[i].inum < entries[j].inum
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	return entries
+}
+
+// matchScanKinds checks the type of the entry by reading the KIND byte of the segment header.
+func (lfs *LogStructuredFS) matchScanKinds(entry scanEntry, kinds []Kind) (bool, error) {
+	if len(kinds) == 0 {
+		return true, nil
+	}
+
+	lfs.drain.RLock()
+	defer lfs.drain.RUnlock()
+
+	lfs.mu.RLock()
+	fd, ok := lfs.regions[entry.regionID]
+	lfs.mu.RUnlock()
+	if !ok {
+		// The region has been collected meanwhile, the segment was moved before.
+		imap := lfs.indexs[entry.inum%uint64(indexShard)]
+		imap.mu.RLock()
+		inode, found := imap.lookup(entry.inum, entry.key)
+		if found {
+			entry.regionID = atomic.LoadUint64(&inode.RegionID)
+			entry.position = atomic.LoadUint64(&inode.Position)
+		}
+		imap.mu.RUnlock()
+		if !found {
+			return false, nil
+		}
+
+		lfs.mu.RLock()
+		fd, ok = lfs.regions[entry.regionID]
+		lfs.mu.RUnlock()
+		if !ok {
+			return false, nil
+		}
+	}
+
+	var header [2]byte
+	_, err := fd.ReadAt(header[:], int64(entry.position))
+	if err != nil {
+		return false, fmt.Errorf("failed to read segment type of %s: %w", entry.key, err)
+	}
+
+	for _, kind := range kinds {
+		if Kind(header[1]) == kind {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,70 @@
+package vfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanPages(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	defer fss.CloseFS()
+
+	var expected []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		seg, err := NewSegment(key, types.NewNumber(int64(i)), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+		expected = append(expected, key)
+	}
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("text:%d", i)
+		seg, err := NewSegment(key, types.Text{Content: "hello"}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	// 分页遍历所有 user: 开头的 key，每个 key 只出现一次
+	cursor, seen := "", make(map[string]int)
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, 100)
+		next, keys, err := fss.Scan(cursor, &ScanOptions{Prefix: "user:", Count: 7})
+		assert.NoError(t, err)
+		for _, key := range keys {
+			seen[key]++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	assert.Len(t, seen, len(expected))
+	for _, key := range expected {
+		assert.Equal(t, 1, seen[key], key)
+	}
+
+	// 按类型过滤
+	next, keys, err := fss.Scan("", &ScanOptions{Kinds: []Kind{Text}, Count: MaxScanCount})
+	assert.NoError(t, err)
+	assert.Empty(t, next)
+	assert.ElementsMatch(t, []string{"text:0", "text:1", "text:2", "text:3", "text:4"}, keys)
+
+	// glob 匹配
+	_, keys, err = fss.Scan("", &ScanOptions{Match: "user:4?", Count: MaxScanCount})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 10)
+
+	_, _, err = fss.Scan("not-a-cursor", &ScanOptions{})
+	assert.Error(t, err)
+}
@@ -3,6 +3,7 @@ package vfs
 import (
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/auula/wiredkv/types"
@@ -21,16 +22,45 @@ const (
 	Unknown
 )
 
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 8 | VLEN 8 | KEY ? | VALUE ? | CRC32 4 |
+var kindNames = map[Kind]string{
+	Set:    "set",
+	ZSet:   "zset",
+	List:   "list",
+	Text:   "text",
+	Table:  "table",
+	Number: "number",
+}
+
+// ParseKind converts a type name used by the HTTP API (e.g. "table") to Kind.
+func ParseKind(name string) (Kind, error) {
+	for kind, kname := range kindNames {
+		if kname == name {
+			return kind, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown data type name: %s", name)
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
 type Segment struct {
-	Tombstone int8
-	Type      Kind
-	ExpiredAt uint64
-	CreatedAt uint64
-	KeySize   uint32
-	ValueSize uint32
-	Key       []byte
-	Value     []byte
+	Tombstone  int8
+	Type       Kind
+	ExpiredAt  uint64
+	CreatedAt  uint64
+	KeySize    uint32 // Size of Key as stored, an encrypted key is larger
+	ValueSize  uint32
+	SlidingTTL uint32 // Sliding expiration window in seconds, 0 if the TTL is fixed
+	LSN        uint64 // Log sequence number, assigned when the segment is appended
+	Codec      Codec  // How the value was encoded, decoding does not depend on the current settings
+	Key        []byte
+	Value      []byte
 }
 
 type Serializable interface {
@@ -55,7 +85,7 @@ func NewSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 	}
 
 	// 这个是通过 transformer 编码之后的
-	encodedata, err := transformer.Encode(bytes)
+	encodedata, codec, err := transformer.Encode(bytes)
 	if err != nil {
 		return nil, fmt.Errorf("transformer encode: %w", err)
 	}
@@ -68,12 +98,28 @@ func NewSegment(key string, data Serializable, ttl uint64) (*Segment, error) {
 		ExpiredAt: expiredAt,
 		KeySize:   uint32(len(key)),
 		ValueSize: uint32(len(encodedata)),
+		Codec:     codec,
 		Key:       []byte(key),
 		Value:     encodedata,
 	}, nil
 
 }
 
+// NewSlidingSegment 初始化一个滑动过期的 Segment，每次成功读取之后过期时间都会延长 window 秒
+func NewSlidingSegment(key string, data Serializable, window uint64) (*Segment, error) {
+	if window == 0 || window > math.MaxUint32 {
+		return nil, fmt.Errorf("sliding ttl %d out of range", window)
+	}
+
+	seg, err := NewSegment(key, data, window)
+	if err != nil {
+		return nil, err
+	}
+	seg.SlidingTTL = uint32(window)
+
+	return seg, nil
+}
+
 func NewTombstoneSegment(key string) *Segment {
 	timestamp, expiredAt := uint64(time.Now().UnixNano()), uint64(0)
 	return &Segment{
@@ -94,7 +140,7 @@ func (s *Segment) IsTombstone() bool {
 
 func (s *Segment) Size() uint32 {
 	// 计算一整块记录的大小，+4 CRC 校验码占用 4 个字节
-	return 26 + s.KeySize + s.ValueSize + 4
+	return SEGMENT_PADDING + s.KeySize + s.ValueSize + 4
 }
 
 func (s *Segment) ToSet() (*types.Set, error) {
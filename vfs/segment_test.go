@@ -51,7 +51,7 @@ func TestSegmentSize(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Ensure the size is calculated correctly
-	assert.Equal(t, uint32(59), segment.Size())
+	assert.Equal(t, uint32(78), segment.Size())
 }
 
 func TestToSet(t *testing.T) {
@@ -0,0 +1,337 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/auula/wiredkv/clog"
+)
+
+// DefaultGarbageRatio is the garbage ratio used when none is configured.
+const DefaultGarbageRatio = 0.5
+
+// RegionStat is the space accounting of a region, Live bytes are referenced by
+// the index and Dead bytes are overwritten, deleted or expired segments,
+// tombstones and batch markers that garbage collection can reclaim.
+type RegionStat struct {
+	RegionID uint64 `json:"region_id"`
+	Live     uint64 `json:"live_bytes"`
+	Dead     uint64 `json:"dead_bytes"`
+}
+
+// GarbageRatio returns the share of dead bytes in the segments of the region.
+func (rs RegionStat) GarbageRatio() float64 {
+	total := rs.Live + rs.Dead
+	if total == 0 {
+		return 0
+	}
+	return float64(rs.Dead) / float64(total)
+}
+
+// regionStats tracks the live and dead bytes of every region. It has its own
+// lock and is always updated last, so it can be used under any other lock.
+type regionStats struct {
+	mu    sync.Mutex
+	stats map[uint64]*RegionStat
+	// oldest is the LSN of the oldest value segment of a region that is no
+	// longer referenced, regions recovered from disk are missing until scanned.
+	oldest map[uint64]uint64
+}
+
+func newRegionStats() *regionStats {
+	return &regionStats{
+		stats:  make(map[uint64]*RegionStat),
+		oldest: make(map[uint64]uint64),
+	}
+}
+
+func (rs *regionStats) get(regionID uint64) *RegionStat {
+	stat, ok := rs.stats[regionID]
+	if !ok {
+		stat = &RegionStat{RegionID: regionID}
+		rs.stats[regionID] = stat
+	}
+	return stat
+}
+
+// addLive accounts a segment referenced by the index.
+func (rs *regionStats) addLive(regionID uint64, size uint32) {
+	rs.mu.Lock()
+	rs.get(regionID).Live += uint64(size)
+	rs.mu.Unlock()
+}
+
+// addDead accounts bytes that are never referenced by the index.
+func (rs *regionStats) addDead(regionID uint64, size uint64) {
+	rs.mu.Lock()
+	rs.get(regionID).Dead += size
+	rs.mu.Unlock()
+}
+
+// release moves the segment of an inode that left the index from live to dead.
+func (rs *regionStats) release(inode *INode) {
+	if inode == nil {
+		return
+	}
+
+	regionID := atomic.LoadUint64(&inode.RegionID)
+	size := uint64(atomic.LoadUint32(&inode.Length))
+
+	rs.mu.Lock()
+	stat := rs.get(regionID)
+	if stat.Live >= size {
+		stat.Live -= size
+	} else {
+		stat.Live = 0
+	}
+	stat.Dead += size
+	rs.observeLocked(regionID, atomic.LoadUint64(&inode.LSN))
+	rs.mu.Unlock()
+}
+
+// track starts the oldest garbage tracking of a new empty region.
+func (rs *regionStats) track(regionID uint64) {
+	rs.mu.Lock()
+	rs.oldest[regionID] = math.MaxUint64
+	rs.mu.Unlock()
+}
+
+// observe accounts a value segment of a region with log sequence number lsn that became garbage.
+func (rs *regionStats) observe(regionID, lsn uint64) {
+	rs.mu.Lock()
+	rs.observeLocked(regionID, lsn)
+	rs.mu.Unlock()
+}
+
+func (rs *regionStats) observeLocked(regionID, lsn uint64) {
+	if oldest, ok := rs.oldest[regionID]; ok && lsn < oldest {
+		rs.oldest[regionID] = lsn
+	}
+}
+
+// drop forgets a region that has been removed.
+func (rs *regionStats) drop(regionID uint64) {
+	rs.mu.Lock()
+	delete(rs.stats, regionID)
+	delete(rs.oldest, regionID)
+	rs.mu.Unlock()
+}
+
+// reset replaces every stat, used after the index has been recovered.
+func (rs *regionStats) reset(stats map[uint64]*RegionStat) {
+	rs.mu.Lock()
+	rs.stats = stats
+	rs.oldest = make(map[uint64]uint64, len(stats))
+	rs.mu.Unlock()
+}
+
+func (rs *regionStats) list() []RegionStat {
+	rs.mu.Lock()
+	stats := make([]RegionStat, 0, len(rs.stats))
+	for _, stat := range rs.stats {
+		stats = append(stats, *stat)
+	}
+	rs.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].RegionID < stats[j].RegionID
+	})
+	return stats
+}
+
+// RegionStats returns the live and dead bytes of every region ordered by region id.
+func (lfs *LogStructuredFS) RegionStats() []RegionStat {
+	return lfs.stats.list()
+}
+
+// rebuildRegionStats computes the stats from the recovered index, everything
+// in a region that is not referenced by an inode is dead. Must be called
+// before the file system is shared.
+func (lfs *LogStructuredFS) rebuildRegionStats() error {
+	stats := make(map[uint64]*RegionStat, len(lfs.regions))
+	for regionID, fd := range lfs.regions {
+		finfo, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		size := uint64(finfo.Size())
+		if size > uint64(len(dataFileMetadata)) {
+			size -= uint64(len(dataFileMetadata))
+		} else {
+			size = 0
+		}
+		// Dead is fixed below, once the live bytes are known.
+		stats[regionID] = &RegionStat{RegionID: regionID, Dead: size}
+	}
+
+	for _, imap := range lfs.indexs {
+		imap.mu.RLock()
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			stat, ok := stats[inode.RegionID]
+			if ok {
+				stat.Live += uint64(inode.Length)
+			}
+			return true
+		})
+		imap.mu.RUnlock()
+	}
+
+	for _, stat := range stats {
+		if stat.Dead >= stat.Live {
+			stat.Dead -= stat.Live
+		} else {
+			stat.Dead = 0
+		}
+	}
+
+	lfs.stats.reset(stats)
+	return nil
+}
+
+// oldestGarbage returns the LSN of the oldest value segment that is no longer
+// referenced in any region but exclude, math.MaxUint64 if there is none.
+func (lfs *LogStructuredFS) oldestGarbage(exclude uint64) uint64 {
+	lfs.mu.RLock()
+	regions := make(map[uint64]*os.File, len(lfs.regions))
+	for regionID, fd := range lfs.regions {
+		regions[regionID] = fd
+	}
+	lfs.mu.RUnlock()
+
+	oldest := uint64(math.MaxUint64)
+	for regionID, fd := range regions {
+		if regionID == exclude {
+			continue
+		}
+
+		lsn, err := lfs.regionGarbage(regionID, fd)
+		if err != nil {
+			// Without knowing the region, it may hold anything.
+			clog.Warnf("failed to scan garbage of region %d: %s", regionID, err)
+			return 0
+		}
+
+		if lsn < oldest {
+			oldest = lsn
+		}
+	}
+
+	return oldest
+}
+
+// regionGarbage returns the oldest garbage of a region, a region recovered from
+// disk is scanned once. The tracking starts before the scan, so segments that
+// become garbage while scanning are accounted as well.
+func (lfs *LogStructuredFS) regionGarbage(regionID uint64, fd *os.File) (uint64, error) {
+	rs := lfs.stats
+	rs.mu.Lock()
+	lsn, ok := rs.oldest[regionID]
+	if !ok {
+		rs.oldest[regionID] = math.MaxUint64
+	}
+	rs.mu.Unlock()
+	if ok {
+		return lsn, nil
+	}
+
+	scanned, err := lfs.scanOldestGarbage(regionID, fd)
+	if err != nil {
+		rs.mu.Lock()
+		delete(rs.oldest, regionID)
+		rs.mu.Unlock()
+		return 0, err
+	}
+
+	rs.mu.Lock()
+	rs.observeLocked(regionID, scanned)
+	lsn = rs.oldest[regionID]
+	rs.mu.Unlock()
+
+	return lsn, nil
+}
+
+// scanOldestGarbage reads the segments of a region and returns the LSN of its
+// oldest value segment not referenced by the index.
+func (lfs *LogStructuredFS) scanOldestGarbage(regionID uint64, fd *os.File) (uint64, error) {
+	finfo, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	oldest := uint64(math.MaxUint64)
+	end := uint64(finfo.Size())
+	offset := uint64(len(dataFileMetadata))
+	for offset < end {
+		size, err := segmentSizeAt(fd, offset, end)
+		if errors.Is(err, errIncompleteSegment) {
+			// An append to the active region is in progress.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? |
+		header := make([]byte, SEGMENT_PADDING)
+		_, err = fd.ReadAt(header, int64(offset))
+		if err != nil {
+			return 0, err
+		}
+
+		lsn := binary.LittleEndian.Uint64(header[30:38])
+		if header[0] == 0 && lsn < oldest {
+			key, err := readSegmentKey(fd, offset, header)
+			if err != nil {
+				return 0, err
+			}
+
+			inum := InodeNum(key)
+			imap := lfs.indexs[inum%uint64(indexShard)]
+			imap.mu.RLock()
+			inode, ok := imap.lookup(inum, key)
+			live := ok && atomic.LoadUint64(&inode.RegionID) == regionID && atomic.LoadUint64(&inode.Position) == offset
+			imap.mu.RUnlock()
+
+			if !live {
+				oldest = lsn
+			}
+		}
+
+		offset += size
+	}
+
+	return oldest, nil
+}
+
+// selectDirtyRegions returns the regions whose garbage ratio and dead bytes reach
+// the thresholds, the dirtiest first. The active region is never selected.
+func (lfs *LogStructuredFS) selectDirtyRegions(ratio float64, minGarbage uint64) []uint64 {
+	lfs.mu.RLock()
+	active := lfs.regionID
+	lfs.mu.RUnlock()
+
+	var victims []RegionStat
+	for _, stat := range lfs.stats.list() {
+		if stat.RegionID == active {
+			continue
+		}
+		if stat.Dead > 0 && stat.Dead >= minGarbage && stat.GarbageRatio() >= ratio {
+			victims = append(victims, stat)
+		}
+	}
+
+	sort.SliceStable(victims, func(i, j int) bool {
+		return victims[i].GarbageRatio() > victims[j].GarbageRatio()
+	})
+
+	regionIds := make([]uint64, 0, len(victims))
+	for _, stat := range victims {
+		regionIds = append(regionIds, stat.RegionID)
+	}
+	return regionIds
+}
@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionStatsAndCompaction(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	// 使用很小的数据文件，让写入分布在多个数据文件中
+	threshold := regionThreshold
+	regionThreshold = 512
+	defer func() { regionThreshold = threshold }()
+
+	put := func(key string, n int64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	for i := 0; i < 30; i++ {
+		put(fmt.Sprintf("key-%02d", i), int64(i))
+	}
+	// 覆盖大部分数据，旧的数据文件中只剩下少量有效数据
+	for i := 0; i < 25; i++ {
+		put(fmt.Sprintf("key-%02d", i), int64(i*10))
+	}
+	assert.NoError(t, fss.DeleteSegment("key-29"))
+
+	liveBytes := func(stats []RegionStat) (live uint64) {
+		for _, stat := range stats {
+			live += stat.Live
+		}
+		return
+	}
+
+	var indexed uint64
+	for _, imap := range fss.indexs {
+		imap.rangeNodes(func(inum uint64, inode *INode) bool {
+			indexed += uint64(inode.Length)
+			return true
+		})
+	}
+	assert.Equal(t, indexed, liveBytes(fss.RegionStats()))
+
+	victims := fss.selectDirtyRegions(DefaultGarbageRatio, 0)
+	assert.NotEmpty(t, victims)
+	for _, regionID := range victims {
+		for _, stat := range fss.RegionStats() {
+			if stat.RegionID == regionID {
+				assert.GreaterOrEqual(t, stat.GarbageRatio(), DefaultGarbageRatio)
+			}
+		}
+	}
+
+	stats, err := fss.RunRegionGC()
+	assert.NoError(t, err)
+	assert.Equal(t, victims, stats.Regions)
+	assert.Greater(t, stats.BytesReclaimed, uint64(0))
+	for _, regionID := range victims {
+		_, ok := fss.regions[regionID]
+		assert.False(t, ok)
+		assert.NoFileExists(t, filepath.Join(opt.Path, formatDataFileName(regionID)))
+	}
+	assert.Equal(t, indexed, liveBytes(fss.RegionStats()))
+
+	check := func(fss *LogStructuredFS) {
+		assert.Equal(t, 29, fss.KeysCount())
+		for i := 0; i < 29; i++ {
+			want := int64(i)
+			if i < 25 {
+				want = int64(i * 10)
+			}
+			_, seg, err := fss.FetchSegment(fmt.Sprintf("key-%02d", i))
+			assert.NoError(t, err)
+			number, err := seg.ToNumber()
+			assert.NoError(t, err)
+			assert.Equal(t, want, number.Value)
+		}
+	}
+	check(fss)
+
+	// 重新扫描数据文件恢复索引，压缩之后的数据依然是最新版本
+	recovered, err := OpenFS(opt)
+	assert.NoError(t, err)
+	regionThreshold = 512
+	check(recovered)
+	assert.Equal(t, indexed, liveBytes(recovered.RegionStats()))
+
+	assert.NoError(t, recovered.CloseFS())
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestGarbageRatioOption(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultGarbageRatio, fss.gcRatio)
+	assert.NoError(t, fss.CloseFS())
+
+	// 配置为 0 的时候回收任何有垃圾数据的数据文件
+	ratio := 0.0
+	fss, err = OpenFS(&Options{
+		FSPerm:       conf.FSPerm,
+		Path:         t.TempDir(),
+		Threshold:    conf.Settings.Region.Threshold,
+		GarbageRatio: &ratio,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, fss.gcRatio)
+	assert.NoError(t, fss.CloseFS())
+}
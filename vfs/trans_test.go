@@ -1,7 +1,18 @@
 package vfs
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
 )
 
 // 测试 Transformer 类的压缩、加密和解密功能
@@ -17,13 +28,13 @@ func TestTransformerWithComplexData(t *testing.T) {
 	transformer.SetEncryptor(AESCryptor, []byte("1234567890123456"))
 
 	// 对数据进行编码（压缩 + 加密）
-	encodedData, err := transformer.Encode([]byte(originalString))
+	encodedData, codec, err := transformer.Encode([]byte(originalString))
 	if err != nil {
 		t.Fatalf("failed to encode data: %v", err)
 	}
 
 	// 解码数据
-	decodedData, err := transformer.Decode(encodedData)
+	decodedData, err := transformer.Decode(codec, encodedData)
 	if err != nil {
 		t.Fatalf("failed to decode data: %v", err)
 	}
@@ -80,3 +91,397 @@ func TestCryptor(t *testing.T) {
 		t.Fatalf("got: %s , need: %s", decrypted, plaintext)
 	}
 }
+
+// 修改压缩和加密配置之后，之前写入的数据依然按照写入时的编码方式读取
+func TestTransformerPerRecordCodec(t *testing.T) {
+	defer func() {
+		transformer = NewTransformer()
+	}()
+
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	put := func(key string) {
+		seg, err := NewSegment(key, *types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("plain")
+	assert.NoError(t, fss.SetCompressor(SnappyCompressor))
+	put("compressed")
+	secret := []byte("1234567890123456")
+	assert.NoError(t, fss.SetEncryptor(AESCryptor, secret))
+	put("encrypted")
+
+	// 没有配置密钥的时候重新打开，全量扫描恢复索引不需要解码数据
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	transformer = NewTransformer()
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fss.KeysCount())
+
+	for _, key := range []string{"plain", "compressed"} {
+		_, seg, err := fss.FetchSegment(key)
+		assert.NoError(t, err)
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, key, text.Content)
+	}
+
+	_, _, err = fss.FetchSegment("encrypted")
+	assert.ErrorContains(t, err, "is not configured")
+
+	// 错误的密钥不会被用来解密
+	assert.NoError(t, fss.SetEncryptor(AESCryptor, []byte("6543210987654321")))
+	_, _, err = fss.FetchSegment("encrypted")
+	assert.ErrorContains(t, err, "is not configured")
+
+	assert.NoError(t, fss.SetEncryptor(AESCryptor, secret))
+	_, seg, err := fss.FetchSegment("encrypted")
+	assert.NoError(t, err)
+	assert.Equal(t, Codec{Compressor: CodecSnappy, Encryptor: CodecAESCBC, KeyID: KeyID(secret)}, seg.Codec)
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "encrypted", text.Content)
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestAEADCryptors(t *testing.T) {
+	secret := []byte("12345678901234567890123456789012")
+	plaintext := []byte("Hello, this is a test of authenticated encryption!")
+
+	for _, name := range []string{CipherAESGCM, CipherChaCha20Poly1305} {
+		encryptor, err := LookupEncryptor(name)
+		assert.NoError(t, err)
+
+		encrypted, err := encryptor.Encrypt(secret, plaintext)
+		assert.NoError(t, err)
+		decrypted, err := encryptor.Decrypt(secret, encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		// 任何一个字节被修改都会被检测到
+		for i := range encrypted {
+			tampered := append([]byte{}, encrypted...)
+			tampered[i] ^= 0x01
+			_, err = encryptor.Decrypt(secret, tampered)
+			assert.ErrorIs(t, err, ErrDecryptFailed)
+		}
+
+		_, err = encryptor.Decrypt(secret, encrypted[:10])
+		assert.ErrorIs(t, err, ErrDecryptFailed)
+
+		_, err = encryptor.Decrypt([]byte("21098765432109876543210987654321"), encrypted)
+		assert.ErrorIs(t, err, ErrDecryptFailed)
+	}
+
+	// 长度不合法的 CBC 密文返回错误，不会 panic
+	secret = []byte("1234567890123456")
+	for _, ciphertext := range [][]byte{nil, make([]byte, 8), make([]byte, 16), make([]byte, 40)} {
+		_, err := AESCryptor.Decrypt(secret, ciphertext)
+		assert.ErrorIs(t, err, ErrDecryptFailed)
+	}
+}
+
+func TestEncryptorRegistry(t *testing.T) {
+	encryptor, err := LookupEncryptor(CipherAESCBC)
+	assert.NoError(t, err)
+	assert.Equal(t, CodecAESCBC, encryptor.ID())
+
+	_, err = LookupEncryptor("rot13")
+	assert.Error(t, err)
+
+	// 名称和编码 ID 都不能重复注册
+	assert.Error(t, RegisterEncryptor(CipherAESGCM, new(ChaChaCryptor)))
+	assert.Error(t, RegisterEncryptor("aes-gcm-copy", new(GCMCryptor)))
+}
+
+func TestCompressors(t *testing.T) {
+	plaintext := []byte(strings.Repeat("Hello, this is a test of compression! ", 16))
+
+	for _, name := range []string{CompressorSnappy, CompressorDeflate, CompressorGzip} {
+		compressor, err := LookupCompressor(name)
+		assert.NoError(t, err)
+
+		compressed, err := compressor.Compress(plaintext)
+		assert.NoError(t, err)
+		assert.Less(t, len(compressed), len(plaintext))
+
+		decompressed, err := compressor.Decompress(compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decompressed)
+
+		_, err = compressor.Decompress([]byte("not compressed"))
+		assert.Error(t, err)
+	}
+
+	_, err := LookupCompressor("zstd")
+	assert.Error(t, err)
+
+	// 名称和编码 ID 都不能重复注册
+	assert.Error(t, RegisterCompressor(CompressorGzip, new(Deflate)))
+	assert.Error(t, RegisterCompressor("gzip-copy", new(Gzip)))
+}
+
+// 小于阈值和压缩之后没有变小的数据保存原始数据，每个数据记录自己是否被压缩
+func TestAdaptiveCompression(t *testing.T) {
+	transformer := NewTransformer()
+	assert.NoError(t, transformer.SetCompressor(DeflateCompressor))
+	transformer.SetCompressionThreshold(64)
+
+	repeated := []byte(strings.Repeat("wiredb", 32))
+	random := make([]byte, 256)
+	_, err := rand.Read(random)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		data       []byte
+		compressor uint8
+	}{
+		{[]byte(strings.Repeat("a", 32)), CodecNone},
+		{repeated, CodecDeflate},
+		{random, CodecNone},
+	}
+
+	for _, tt := range tests {
+		encoded, codec, err := transformer.Encode(tt.data)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.compressor, codec.Compressor)
+		if codec.Compressor == CodecNone {
+			assert.Equal(t, tt.data, encoded)
+		}
+
+		decoded, err := transformer.Decode(codec, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.data, decoded)
+	}
+
+	// 换成其他压缩算法之后之前的数据依然可以读取
+	encoded, codec, err := transformer.Encode(repeated)
+	assert.NoError(t, err)
+	assert.NoError(t, transformer.SetCompressor(GzipCompressor))
+	decoded, err := transformer.Decode(codec, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, repeated, decoded)
+}
+
+// 修改配置的同时编码数据，每次编码都使用一个完整的配置
+func TestTransformerConcurrentConfig(t *testing.T) {
+	transformer := NewTransformer()
+	data := []byte(strings.Repeat("wiredb", 32))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				encoded, codec, err := transformer.Encode(data)
+				assert.NoError(t, err)
+				decoded, err := transformer.Decode(codec, encoded)
+				assert.NoError(t, err)
+				assert.Equal(t, data, decoded)
+			}
+		}()
+	}
+
+	for j := 0; j < 100; j++ {
+		assert.NoError(t, transformer.SetCompressor(GzipCompressor))
+		transformer.SetCompressionThreshold(j)
+		assert.NoError(t, transformer.SetEncryptor(AESGCMCryptor, []byte("1234567890123456")))
+		transformer.DisableAll()
+	}
+	wg.Wait()
+}
+
+// 篡改之后重新计算 CRC 的数据在解密的时候被发现
+func TestTamperedSegment(t *testing.T) {
+	defer func() {
+		transformer = NewTransformer()
+	}()
+
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.SetEncryptor(AESGCMCryptor, []byte("12345678901234567890123456789012")))
+
+	seg, err := NewSegment("secret", *types.NewText("top secret"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, CodecAESGCM, seg.Codec.Encryptor)
+	assert.NoError(t, fss.PutSegment("secret", seg))
+
+	inum := InodeNum("secret")
+	imap := fss.indexs[inum%uint64(indexShard)]
+	inode, ok := imap.lookup(inum, "secret")
+	assert.True(t, ok)
+
+	fd := fss.regions[inode.RegionID]
+	raw := make([]byte, inode.Length)
+	_, err = fd.ReadAt(raw, int64(inode.Position))
+	assert.NoError(t, err)
+
+	size := len(raw)
+	raw[size-5] ^= 0x01
+	binary.LittleEndian.PutUint32(raw[size-4:], crc32.ChecksumIEEE(raw[:size-4]))
+	file, err := os.OpenFile(filepath.Join(opt.Path, formatDataFileName(inode.RegionID)), os.O_WRONLY, conf.FSPerm)
+	assert.NoError(t, err)
+	_, err = file.WriteAt(raw, int64(inode.Position))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	_, _, err = fss.FetchSegment("secret")
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+// 开启 key 加密之后数据文件和索引快照中都没有明文的 key，查询不受影响
+func TestKeyEncryption(t *testing.T) {
+	defer func() {
+		transformer = NewTransformer()
+	}()
+
+	keyring, err := NewKeyring([]byte("12345678901234567890123456789012"))
+	assert.NoError(t, err)
+
+	opt := &Options{
+		FSPerm:      conf.FSPerm,
+		Path:        t.TempDir(),
+		Threshold:   conf.Settings.Region.Threshold,
+		Encryptor:   AESGCMCryptor,
+		Keyring:     keyring,
+		EncryptKeys: true,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	keys := []string{"user:alice@example.com", "user:bob@example.com", "user:carol@example.com"}
+	for _, key := range keys[:2] {
+		seg, err := NewSegment(key, *types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	batch := NewWriteBatch()
+	seg, err := NewSegment(keys[2], *types.NewText(keys[2]), 0)
+	assert.NoError(t, err)
+	batch.Put(keys[2], seg)
+	batch.Delete(keys[1])
+	assert.NoError(t, fss.WriteBatch(batch))
+
+	changes, _, err := fss.ReadChanges(0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 4)
+	assert.Equal(t, keys[1], changes[3].Key)
+	assert.True(t, changes[3].Deleted)
+
+	_, seg, err = fss.FetchSegment(keys[0])
+	assert.NoError(t, err)
+	assert.Equal(t, keys[0], string(seg.Key))
+	assert.Equal(t, CodecEncryptedKey, seg.Codec.Flags)
+	assert.NoError(t, fss.CloseFS())
+
+	// 数据文件和索引快照中都找不到明文的 key
+	assertSealed := func() {
+		files, err := os.ReadDir(opt.Path)
+		assert.NoError(t, err)
+		for _, file := range files {
+			data, err := os.ReadFile(filepath.Join(opt.Path, file.Name()))
+			assert.NoError(t, err)
+			assert.NotContains(t, string(data), "example.com", file.Name())
+		}
+	}
+	assertSealed()
+
+	// 通过索引快照和全量扫描恢复的索引都可以查询
+	for i := 0; i < 2; i++ {
+		fss, err = OpenFS(opt)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{keys[0], keys[2]}, fss.Keys("user:"))
+		_, seg, err = fss.FetchSegment(keys[2])
+		assert.NoError(t, err)
+		text, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, keys[2], text.Content)
+		_, _, err = fss.FetchSegment(keys[1])
+		assert.Error(t, err)
+		assert.NoError(t, fss.CloseFS())
+		assertSealed()
+		assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	}
+
+	// 没有密钥的时候不能恢复索引
+	transformer = NewTransformer()
+	_, err = OpenFS(&Options{FSPerm: conf.FSPerm, Path: opt.Path, Threshold: opt.Threshold})
+	assert.ErrorIs(t, err, ErrDecryptFailed)
+
+	_, err = OpenFS(&Options{FSPerm: conf.FSPerm, Path: opt.Path, Threshold: opt.Threshold, EncryptKeys: true})
+	assert.Error(t, err)
+}
+
+// 开启 key 加密之前写入的明文 key 在重新加密的时候也会被加密
+func TestReencryptPlaintextKeys(t *testing.T) {
+	defer func() {
+		transformer = NewTransformer()
+	}()
+
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+	for _, key := range []string{"user:alice@example.com", "user:bob@example.com"} {
+		seg, err := NewSegment(key, *types.NewText(key), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+	assert.NoError(t, fss.DeleteSegment("user:bob@example.com"))
+	assert.NoError(t, fss.CloseFS())
+
+	keyring, err := NewKeyring([]byte("1234567890123456"))
+	assert.NoError(t, err)
+	opt.Encryptor, opt.Keyring, opt.EncryptKeys = AESGCMCryptor, keyring, true
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+
+	fss.mu.Lock()
+	assert.NoError(t, fss.createActiveRegion())
+	fss.mu.Unlock()
+
+	stats, err := fss.ReencryptRegions()
+	assert.NoError(t, err)
+	assert.Len(t, stats.Regions, 1)
+	// 没有其他数据文件保存 bob 的旧版本，删除标记直接被丢弃
+	assert.Equal(t, uint64(1), stats.Reencrypted)
+
+	_, seg, err := fss.FetchSegment("user:alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, Codec{Encryptor: CodecAESGCM, KeyID: keyring.ActiveID(), Flags: CodecEncryptedKey}, seg.Codec)
+	assert.NoError(t, fss.CloseFS())
+
+	files, err := os.ReadDir(opt.Path)
+	assert.NoError(t, err)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(opt.Path, file.Name()))
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "example.com", file.Name())
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
 )
@@ -18,116 +22,237 @@ var (
 
 const (
 	// 使用整数位标志存储状态
-	EnabledEncryption  = 1 << iota // 1: 0001
-	EnabledCompression             // 2: 0010
+	EnabledEncryption    = 1 << iota // 1: 0001
+	EnabledCompression               // 2: 0010
+	EnabledKeyEncryption             // 4: 0100
+)
+
+// Codec IDs are recorded in the segment header, an ID must never be reused for another algorithm.
+const (
+	CodecNone    uint8 = 0 // Value is stored as is
+	CodecSnappy  uint8 = 1 // Compressor: Snappy
+	CodecDeflate uint8 = 2 // Compressor: DEFLATE
+	CodecGzip    uint8 = 3 // Compressor: gzip
+	CodecAESCBC  uint8 = 1 // Encryptor: AES-CBC
+	CodecAESGCM  uint8 = 2 // Encryptor: AES-GCM
+
+	CodecChaCha20Poly1305 uint8 = 3 // Encryptor: ChaCha20-Poly1305
+
+	// CodecEncryptedKey is set in Codec.Flags when the key is encrypted like the value.
+	CodecEncryptedKey uint8 = 1 << 0
 )
 
 // 压缩和解密应该针对数据的 VALUE ? 部分进行压缩，这里针对的是不定长部分进行压缩和解密
-// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | KEY ? | VALUE ? | CRC32 4 |
+// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
 type Compressor interface {
+	ID() uint8
 	Compress(data []byte) ([]byte, error)
 	Decompress(data []byte) ([]byte, error)
 }
 
 type Encryptor interface {
+	ID() uint8
 	Encrypt(secret, plianttext []byte) ([]byte, error)
 	Decrypt(secret, ciphertext []byte) ([]byte, error)
 }
 
+// Codec is the pipeline a value was encoded with, stored with every segment as
+// | CMP 1 | ENC 1 | KID 4 | FLG 1 |. KeyID identifies the secret of the encryptor,
+// a key with CodecEncryptedKey in Flags is encrypted with the same encryptor and secret.
+type Codec struct {
+	Compressor uint8
+	Encryptor  uint8
+	KeyID      uint32
+	Flags      uint8
+}
+
+// KeyID returns the ID recorded for values encrypted with secret, it is derived
+// from the secret so a value is never decrypted with the wrong one.
+func KeyID(secret []byte) uint32 {
+	sum := sha256.Sum256(secret)
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// Transformer encodes new values with its codec config and decodes any value with
+// the codec recorded for it. The config is immutable, the setters publish a changed
+// copy, so Encode and Decode on the request goroutines never see a partial update.
 type Transformer struct {
-	Encryptor
-	Compressor
-	flags  int
-	secret []byte
+	mu     sync.Mutex // Serializes the setters
+	config atomic.Pointer[codecConfig]
+}
+
+// codecConfig is the encoding of new values, it is never modified once published.
+type codecConfig struct {
+	encryptor  Encryptor
+	compressor Compressor
+	flags      int
+	keyring    *Keyring
+	// Values shorter than minCompressSize bytes are stored raw
+	minCompressSize int
 }
 
 func NewTransformer() *Transformer {
-	return &Transformer{
-		flags:      0,
-		Encryptor:  nil,
-		Compressor: nil,
-	}
+	t := new(Transformer)
+	t.config.Store(new(codecConfig))
+	return t
+}
+
+// update publishes a copy of the current config changed by fn.
+func (t *Transformer) update(fn func(config *codecConfig)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	config := *t.config.Load()
+	fn(&config)
+	t.config.Store(&config)
 }
 
 func (t *Transformer) EnableEncryption() {
-	t.flags |= EnabledEncryption
+	t.update(func(config *codecConfig) { config.flags |= EnabledEncryption })
 }
 
 func (t *Transformer) EnableCompression() {
-	t.flags |= EnabledCompression
+	t.update(func(config *codecConfig) { config.flags |= EnabledCompression })
 }
 
 func (t *Transformer) DisableEncryption() {
-	t.flags &^= EnabledEncryption
+	t.update(func(config *codecConfig) { config.flags &^= EnabledEncryption })
 }
 
 func (t *Transformer) DisableCompression() {
-	t.flags &^= EnabledCompression
+	t.update(func(config *codecConfig) { config.flags &^= EnabledCompression })
 }
 
 func (t *Transformer) IsEncryptionEnabled() bool {
-	return t.flags&EnabledEncryption != 0
+	return t.config.Load().flags&EnabledEncryption != 0
 }
 
 func (t *Transformer) IsCompressionEnabled() bool {
-	return t.flags&EnabledCompression != 0
+	return t.config.Load().flags&EnabledCompression != 0
+}
+
+// EnableKeyEncryption also encrypts the keys of new segments and the index snapshot,
+// it only takes effect while encryption is enabled.
+func (t *Transformer) EnableKeyEncryption() {
+	t.update(func(config *codecConfig) { config.flags |= EnabledKeyEncryption })
+}
+
+func (t *Transformer) DisableKeyEncryption() {
+	t.update(func(config *codecConfig) { config.flags &^= EnabledKeyEncryption })
+}
+
+func (t *Transformer) IsKeyEncryptionEnabled() bool {
+	return t.config.Load().flags&EnabledKeyEncryption != 0
 }
 
 func (t *Transformer) DisableAll() {
-	t.flags = 0
+	t.update(func(config *codecConfig) { config.flags = 0 })
 }
 
 func (t *Transformer) SetEncryptor(encryptor Encryptor, secret []byte) error {
-	if len(secret) < 16 {
-		return errors.New("secret key char length too short")
+	keyring, err := NewKeyring(secret)
+	if err != nil {
+		return err
 	}
-	t.secret = secret
-	t.Encryptor = encryptor
-	t.EnableEncryption()
+	return t.SetKeyring(encryptor, keyring)
+}
+
+// SetKeyring encrypts new values with encryptor and the active secret of keyring,
+// values encrypted with a retired secret can still be decrypted.
+func (t *Transformer) SetKeyring(encryptor Encryptor, keyring *Keyring) error {
+	// Values are decrypted with the registered encryptor of their codec.
+	if _, ok := encryptorByID(encryptor.ID()); !ok {
+		return fmt.Errorf("encryptor codec id %d is not registered", encryptor.ID())
+	}
+	t.update(func(config *codecConfig) {
+		config.keyring = keyring
+		config.encryptor = encryptor
+		config.flags |= EnabledEncryption
+	})
 	return nil
 }
 
-func (t *Transformer) SetCompressor(compressor Compressor) {
-	t.Compressor = compressor
-	t.EnableCompression()
+func (t *Transformer) SetCompressor(compressor Compressor) error {
+	// Values are decompressed with the registered compressor of their codec.
+	if _, ok := compressorByID(compressor.ID()); !ok {
+		return fmt.Errorf("compressor codec id %d is not registered", compressor.ID())
+	}
+	t.update(func(config *codecConfig) {
+		config.compressor = compressor
+		config.flags |= EnabledCompression
+	})
+	return nil
 }
 
-func (t *Transformer) Encode(data []byte) ([]byte, error) {
-	var err error
-	// 压缩数据
-	if t.IsCompressionEnabled() && t.Compressor != nil {
-		data, err = t.Compress(data)
+// SetCompressionThreshold stores values shorter than size bytes raw, compressing
+// them costs more time than it saves space.
+func (t *Transformer) SetCompressionThreshold(size int) {
+	t.update(func(config *codecConfig) { config.minCompressSize = size })
+}
+
+func (config *codecConfig) encrypts() bool {
+	return config.flags&EnabledEncryption != 0 && config.encryptor != nil
+}
+
+func (config *codecConfig) compresses() bool {
+	return config.flags&EnabledCompression != 0 && config.compressor != nil
+}
+
+// Encode encodes data with the enabled compressor and encryptor and returns the
+// codec to store with it. Data below the compression threshold or that does not
+// get smaller is stored uncompressed, the codec records the choice for each value.
+func (t *Transformer) Encode(data []byte) ([]byte, Codec, error) {
+	var (
+		err   error
+		codec Codec
+	)
+
+	config := t.config.Load()
+
+	// 压缩数据，压缩之后没有变小就保存原始数据
+	if config.compresses() && len(data) >= config.minCompressSize {
+		compressed, err := config.compressor.Compress(data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compress data: %w", err)
+			return nil, codec, fmt.Errorf("failed to compress data: %w", err)
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+			codec.Compressor = config.compressor.ID()
 		}
-
 	}
 
 	// 加密数据
-	if t.IsEncryptionEnabled() && t.Encryptor != nil {
-		data, err = t.Encrypt(t.secret, data)
+	if config.encrypts() {
+		secret, _ := config.keyring.secret(config.keyring.active)
+		data, err = config.encryptor.Encrypt(secret, data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to encrypt data: %w", err)
+			return nil, codec, fmt.Errorf("failed to encrypt data: %w", err)
 		}
+		codec.Encryptor = config.encryptor.ID()
+		codec.KeyID = config.keyring.active
 	}
 
-	return data, nil
+	return data, codec, nil
 }
 
-// fd 必须实现 io.ReadWriteCloser 接口
-func (t *Transformer) Decode(data []byte) ([]byte, error) {
+// Decode reverses the pipeline recorded in codec, regardless of what is enabled now.
+func (t *Transformer) Decode(codec Codec, data []byte) ([]byte, error) {
 	var err error
 	// 解密数据
-	if t.IsEncryptionEnabled() && t.Encryptor != nil {
-		data, err = t.Decrypt(t.secret, data)
+	if codec.Encryptor != CodecNone {
+		data, err = t.decrypt(codec, data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt data: %w", err)
+			return nil, err
 		}
 	}
 
 	// 解压缩数据
-	if t.IsCompressionEnabled() && t.Compressor != nil {
-		data, err = t.Decompress(data)
+	if codec.Compressor != CodecNone {
+		compressor, ok := compressorByID(codec.Compressor)
+		if !ok {
+			return nil, fmt.Errorf("failed to decompress data: unknown compressor codec %d", codec.Compressor)
+		}
+		data, err = compressor.Decompress(data)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decompress data: %w", err)
 		}
@@ -136,8 +261,113 @@ func (t *Transformer) Decode(data []byte) ([]byte, error) {
 	return data, nil
 }
 
+// EncodeKey encrypts key if key encryption is enabled. The key of a value shares
+// its encryptor and secret, a key without encrypted value uses the active ones.
+func (t *Transformer) EncodeKey(key []byte, codec Codec) ([]byte, Codec, error) {
+	config := t.config.Load()
+	active, ok := config.keyCodec()
+	if !ok {
+		return key, codec, nil
+	}
+
+	if codec.Encryptor == CodecNone {
+		codec.Encryptor, codec.KeyID = active.Encryptor, active.KeyID
+	}
+
+	data, err := config.encrypt(codec, key)
+	if err != nil {
+		return nil, codec, fmt.Errorf("failed to encrypt key: %w", err)
+	}
+	codec.Flags |= CodecEncryptedKey
+
+	return data, codec, nil
+}
+
+// DecodeKey decrypts a key stored with codec, a plaintext key is returned as is.
+func (t *Transformer) DecodeKey(codec Codec, key []byte) ([]byte, error) {
+	if codec.Flags&CodecEncryptedKey == 0 {
+		return key, nil
+	}
+	return t.decrypt(codec, key)
+}
+
+// keyCodec returns the codec keys and index snapshots are encrypted with,
+// false if key encryption is not in effect.
+func (t *Transformer) keyCodec() (Codec, bool) {
+	return t.config.Load().keyCodec()
+}
+
+func (config *codecConfig) keyCodec() (Codec, bool) {
+	if config.flags&EnabledKeyEncryption == 0 || !config.encrypts() {
+		return Codec{}, false
+	}
+	return Codec{Encryptor: config.encryptor.ID(), KeyID: config.keyring.active}, true
+}
+
+// encrypt encrypts data with the encryptor and secret recorded in codec.
+func (t *Transformer) encrypt(codec Codec, data []byte) ([]byte, error) {
+	return t.config.Load().encrypt(codec, data)
+}
+
+func (config *codecConfig) encrypt(codec Codec, data []byte) ([]byte, error) {
+	encryptor, ok := encryptorByID(codec.Encryptor)
+	if !ok {
+		return nil, fmt.Errorf("unknown encryptor codec %d", codec.Encryptor)
+	}
+	secret, ok := config.keyring.secret(codec.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("secret with key id %08x is not configured", codec.KeyID)
+	}
+	return encryptor.Encrypt(secret, data)
+}
+
+// decrypt decrypts data with the encryptor and secret recorded in codec, every
+// failure wraps ErrDecryptFailed.
+func (t *Transformer) decrypt(codec Codec, data []byte) ([]byte, error) {
+	encryptor, ok := encryptorByID(codec.Encryptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown encryptor codec %d", ErrDecryptFailed, codec.Encryptor)
+	}
+	secret, ok := t.config.Load().keyring.secret(codec.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("%w: secret with key id %08x is not configured", ErrDecryptFailed, codec.KeyID)
+	}
+
+	data, err := encryptor.Decrypt(secret, data)
+	if errors.Is(err, ErrDecryptFailed) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptFailed, err)
+	}
+	return data, nil
+}
+
+// stale reports whether a segment stored with codec is not encrypted like new
+// segments, with another cipher, a retired secret, not at all or with a plaintext
+// key while key encryption is enabled. Tombstones carry no value, only their key counts.
+func (t *Transformer) stale(codec Codec, tombstone bool) bool {
+	config := t.config.Load()
+	if !config.encrypts() {
+		return false
+	}
+
+	encryptedKey := codec.Flags&CodecEncryptedKey != 0
+	if config.flags&EnabledKeyEncryption != 0 && !encryptedKey {
+		return true
+	}
+	if tombstone && !encryptedKey {
+		return false
+	}
+	return codec.Encryptor != config.encryptor.ID() || codec.KeyID != config.keyring.active
+}
+
 type Snappy struct{}
 
+func (s *Snappy) ID() uint8 {
+	return CodecSnappy
+}
+
 func (s *Snappy) Compress(data []byte) ([]byte, error) {
 	// Snappy 压缩数据
 	compressed := snappy.Encode(nil, data)
@@ -151,6 +381,10 @@ func (s *Snappy) Decompress(data []byte) ([]byte, error) {
 
 type Cryptor struct{}
 
+func (c *Cryptor) ID() uint8 {
+	return CodecAESCBC
+}
+
 func (c *Cryptor) Encrypt(secret, plaintext []byte) ([]byte, error) {
 	// Create AES cipher block
 	block, err := aes.NewCipher(secret)
@@ -186,6 +420,12 @@ func (c *Cryptor) Decrypt(secret, ciphertext []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	// CBC has no authentication, only malformed ciphertext can be detected.
+	size := block.BlockSize()
+	if len(ciphertext) < 2*size || len(ciphertext)%size != 0 {
+		return nil, fmt.Errorf("%w: ciphertext is not a whole number of blocks", ErrDecryptFailed)
+	}
+
 	// Extract IV from the beginning of ciphertext
 	iv := ciphertext[:block.BlockSize()]
 	ciphertext = ciphertext[block.BlockSize():]
@@ -197,5 +437,8 @@ func (c *Cryptor) Decrypt(secret, ciphertext []byte) ([]byte, error) {
 
 	// Remove padding
 	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > size || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("%w: invalid padding", ErrDecryptFailed)
+	}
 	return plaintext[:len(plaintext)-padding], nil
 }
@@ -0,0 +1,187 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+)
+
+// ExpireSegment sets the TTL of key to ttl from now and returns the new expiration time.
+func (lfs *LogStructuredFS) ExpireSegment(key string, ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be greater than 0")
+	}
+
+	return lfs.updateExpiry(key, func(now, expiredAt uint64) uint64 {
+		return now + uint64(ttl)
+	})
+}
+
+// ExtendSegment adds delta to the remaining TTL of key, a key without TTL
+// expires delta from now. It returns the new expiration time.
+func (lfs *LogStructuredFS) ExtendSegment(key string, delta time.Duration) (uint64, error) {
+	if delta <= 0 {
+		return 0, errors.New("ttl extension must be greater than 0")
+	}
+
+	return lfs.updateExpiry(key, func(now, expiredAt uint64) uint64 {
+		if expiredAt < now {
+			expiredAt = now
+		}
+		return expiredAt + uint64(delta)
+	})
+}
+
+// PersistSegment removes the TTL of key.
+func (lfs *LogStructuredFS) PersistSegment(key string) error {
+	_, err := lfs.updateExpiry(key, func(now, expiredAt uint64) uint64 {
+		return 0
+	})
+	return err
+}
+
+// SegmentTTL returns the remaining lifetime of key in nanoseconds like Segment.TTL,
+// -1 if the key has no TTL. It only reads the index.
+func (lfs *LogStructuredFS) SegmentTTL(key string) (int64, error) {
+	inum := InodeNum(key)
+	imap := lfs.indexs[inum%uint64(indexShard)]
+
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum, key)
+	var expiredAt uint64
+	if ok {
+		expiredAt = atomic.LoadUint64(&inode.ExpiredAt)
+	}
+	imap.mu.RUnlock()
+
+	now := uint64(time.Now().UnixNano())
+	if !ok || (expiredAt != 0 && expiredAt <= now) {
+		return 0, ErrKeyNotFound
+	}
+
+	if expiredAt == 0 {
+		return -1, nil
+	}
+	return int64(expiredAt - now), nil
+}
+
+func (lfs *LogStructuredFS) updateExpiry(key string, expire func(now, expiredAt uint64) uint64) (uint64, error) {
+	seq, expiredAt, err := lfs.rewriteExpiry(key, expire)
+	if err != nil {
+		return 0, err
+	}
+	return expiredAt, lfs.commitWrite(seq)
+}
+
+// rewriteExpiry appends a copy of the segment of key with a new expiration time.
+// The value is copied as it was written, only the header and checksum change.
+func (lfs *LogStructuredFS) rewriteExpiry(key string, expire func(now, expiredAt uint64) uint64) (uint64, uint64, error) {
+	inum := InodeNum(key)
+	imap := lfs.indexs[inum%uint64(indexShard)]
+
+	lfs.mu.Lock()
+	defer lfs.mu.Unlock()
+
+	// Other writers wait on lfs.mu, garbage collection may still move the inode,
+	// its old copy stays readable until the region is removed under lfs.mu.
+	imap.mu.RLock()
+	inode, ok := imap.lookup(inum, key)
+	imap.mu.RUnlock()
+
+	now := uint64(time.Now().UnixNano())
+	if !ok {
+		return 0, 0, ErrKeyNotFound
+	}
+
+	current := atomic.LoadUint64(&inode.ExpiredAt)
+	if current != 0 && current <= now {
+		return 0, 0, ErrKeyNotFound
+	}
+
+	// Regions are only removed under lfs.mu, the region can not go away while reading.
+	fd, ok := lfs.regions[atomic.LoadUint64(&inode.RegionID)]
+	if !ok {
+		return 0, 0, fmt.Errorf("data region with ID %d not found", inode.RegionID)
+	}
+
+	raw := make([]byte, atomic.LoadUint32(&inode.Length))
+	_, err := fd.ReadAt(raw, int64(atomic.LoadUint64(&inode.Position)))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read segment: %w", err)
+	}
+
+	size := len(raw)
+	if binary.LittleEndian.Uint32(raw[size-4:]) != crc32.ChecksumIEEE(raw[:size-4]) {
+		return 0, 0, errors.New("failed to crc32 checksum mismatch")
+	}
+
+	// | DEL 1 | KIND 1 | EAT 8 | CAT 8 | KLEN 4 | VLEN 4 | SLD 4 | LSN 8 | CMP 1 | ENC 1 | KID 4 | FLG 1 | KEY ? | VALUE ? | CRC32 4 |
+	// The copy gets a new log sequence number, recovery keeps the newest segment of a key.
+	expiredAt := expire(now, current)
+	binary.LittleEndian.PutUint64(raw[2:10], expiredAt)
+	// A key without expiration has no sliding window either.
+	if expiredAt == 0 {
+		binary.LittleEndian.PutUint32(raw[26:30], 0)
+	}
+	lfs.sequence++
+	binary.LittleEndian.PutUint64(raw[30:38], lfs.sequence)
+	binary.LittleEndian.PutUint32(raw[size-4:], crc32.ChecksumIEEE(raw[:size-4]))
+
+	err = appendToActiveRegion(lfs.active, raw)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imap.mu.Lock()
+	old := imap.insert(inum, &INode{
+		RegionID:   lfs.regionID,
+		Position:   lfs.offset,
+		Length:     uint32(size),
+		CreatedAt:  inode.CreatedAt,
+		ExpiredAt:  expiredAt,
+		Key:        key,
+		SlidingTTL: binary.LittleEndian.Uint32(raw[26:30]),
+		LSN:        lfs.sequence,
+	})
+	imap.mu.Unlock()
+
+	lfs.stats.release(old)
+	lfs.stats.addLive(lfs.regionID, uint32(size))
+	lfs.expiry.push(inum, key, lfs.sequence, expiredAt)
+
+	lfs.offset += uint64(size)
+	lfs.notifyCheckpoint()
+
+	if lfs.offset >= uint64(regionThreshold) {
+		return lfs.sequence, expiredAt, lfs.createActiveRegion()
+	}
+
+	return lfs.sequence, expiredAt, nil
+}
+
+// slideExpiry moves the expiration of a sliding key one window past now and returns it.
+// The new expiration only lives in the index, it reaches the disk with the next index
+// snapshot instead of rewriting the segment on every read. After recovering from the
+// regions alone a sliding key expires one window after its last write.
+func slideExpiry(inode *INode, cp *checkpoint) uint64 {
+	now := uint64(time.Now().UnixNano())
+	expiredAt := now + uint64(inode.SlidingTTL)*uint64(time.Second)
+	for {
+		current := atomic.LoadUint64(&inode.ExpiredAt)
+		// An expired key is never revived by a read that raced with its expiration.
+		if current >= expiredAt || current <= now {
+			return current
+		}
+		if atomic.CompareAndSwapUint64(&inode.ExpiredAt, current, expiredAt) {
+			break
+		}
+	}
+
+	if cp != nil {
+		atomic.StoreUint32(&cp.refreshed, 1)
+	}
+	return expiredAt
+}
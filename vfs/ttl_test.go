@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentTTL(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	seg, err := NewSegment("cart", *types.NewText("apple"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("cart", seg))
+
+	ttl, err := fss.SegmentTTL("cart")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), ttl)
+
+	// 只修改过期时间，数据保持不变
+	expiredAt, err := fss.ExpireSegment("cart", time.Hour)
+	assert.NoError(t, err)
+	_, seg, err = fss.FetchSegment("cart")
+	assert.NoError(t, err)
+	assert.Equal(t, expiredAt, seg.ExpiredAt)
+	assert.Greater(t, seg.TTL(), int64(59*time.Minute))
+	text, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "apple", text.Content)
+
+	extended, err := fss.ExtendSegment("cart", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, expiredAt+uint64(time.Hour), extended)
+
+	ttl, err = fss.SegmentTTL("cart")
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, int64(119*time.Minute))
+
+	// 全量扫描恢复的索引保留最后一次修改的过期时间
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	ttl, err = fss.SegmentTTL("cart")
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, int64(119*time.Minute))
+
+	assert.NoError(t, fss.PersistSegment("cart"))
+	ttl, err = fss.SegmentTTL("cart")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), ttl)
+
+	assert.NoError(t, fss.CloseFS())
+	assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	_, seg, err = fss.FetchSegment("cart")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), seg.TTL())
+
+	// 不存在和已经过期的数据不能修改过期时间
+	_, err = fss.ExpireSegment("missing", time.Hour)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = fss.ExpireSegment("cart", time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = fss.ExtendSegment("cart", time.Hour)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = fss.SegmentTTL("cart")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	assert.NoError(t, fss.CloseFS())
+}
+
+func TestSlidingTTL(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+
+	_, err = NewSlidingSegment("session", *types.NewText("token"), 0)
+	assert.Error(t, err)
+
+	seg, err := NewSlidingSegment("session", *types.NewText("token"), 2)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("session", seg))
+
+	// 每次读取都会延长过期时间，数据文件没有新的写入
+	fss.mu.RLock()
+	offset := fss.offset
+	fss.mu.RUnlock()
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Second)
+		_, seg, err = fss.FetchSegment("session")
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), seg.SlidingTTL)
+		assert.Greater(t, seg.TTL(), int64(time.Second+900*time.Millisecond))
+	}
+	fss.mu.RLock()
+	assert.Equal(t, offset, fss.offset)
+	fss.mu.RUnlock()
+
+	// 没有读取的时候正常过期，后台清理也会处理被延长过的过期时间
+	reaped, err := fss.reapExpired(DefaultExpireBatch)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+	assert.Equal(t, 1, fss.expiry.len())
+	assert.Equal(t, 1, fss.KeysCount())
+
+	// 延长之后的过期时间通过索引快照持久化
+	_, seg, err = fss.FetchSegment("session")
+	assert.NoError(t, err)
+	assert.NoError(t, fss.CloseFS())
+	fss, err = OpenFS(opt)
+	assert.NoError(t, err)
+	ttl, err := fss.SegmentTTL("session")
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, int64(time.Second))
+	_, seg, err = fss.FetchSegment("session")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), seg.SlidingTTL)
+
+	time.Sleep(2100 * time.Millisecond)
+	_, _, err = fss.FetchSegment("session")
+	assert.Error(t, err)
+
+	// 移除过期时间的同时也移除了滑动窗口
+	seg, err = NewSlidingSegment("session", *types.NewText("token"), 60)
+	assert.NoError(t, err)
+	assert.NoError(t, fss.PutSegment("session", seg))
+	assert.NoError(t, fss.PersistSegment("session"))
+	_, seg, err = fss.FetchSegment("session")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), seg.SlidingTTL)
+	assert.Equal(t, int64(-1), seg.TTL())
+
+	assert.NoError(t, fss.CloseFS())
+}
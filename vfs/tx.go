@@ -0,0 +1,67 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Watch is the state of a key observed by an optimistic transaction,
+// the transaction only commits if the key is still in that state.
+type Watch struct {
+	Key     string
+	Version uint64 // Version returned by FetchSegment, ignored if Exists is false
+	Exists  bool   // false expects the key to be absent
+}
+
+// ConflictError is returned by WriteBatchIf when watched keys have changed.
+type ConflictError struct {
+	Keys []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("transaction conflict on keys: %s", strings.Join(e.Keys, ", "))
+}
+
+// WriteBatchIf applies batch like WriteBatch, but only if every watched key is
+// unchanged, otherwise nothing is written and a *ConflictError lists the changed keys.
+// An empty batch only validates the watches.
+func (lfs *LogStructuredFS) WriteBatchIf(watches []Watch, batch *WriteBatch) error {
+	seq, err := lfs.writeBatch(watches, batch)
+	if err != nil {
+		return err
+	}
+	return lfs.commitWrite(seq)
+}
+
+// checkWatches compares the watched keys with the index, lfs.mu must be held.
+func (lfs *LogStructuredFS) checkWatches(watches []Watch) error {
+	now := uint64(time.Now().UnixNano())
+
+	var conflicts []string
+	for _, watch := range watches {
+		inum := InodeNum(watch.Key)
+		imap := lfs.indexs[inum%uint64(indexShard)]
+
+		imap.mu.RLock()
+		inode, ok := imap.lookup(inum, watch.Key)
+		var version uint64
+		if ok {
+			expiredAt := atomic.LoadUint64(&inode.ExpiredAt)
+			ok = expiredAt == 0 || expiredAt > now
+			version = atomic.LoadUint64(&inode.LSN)
+		}
+		imap.mu.RUnlock()
+
+		if ok != watch.Exists || (ok && version != watch.Version) {
+			conflicts = append(conflicts, watch.Key)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return &ConflictError{Keys: conflicts}
+	}
+
+	return nil
+}
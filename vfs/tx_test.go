@@ -0,0 +1,85 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatchIf(t *testing.T) {
+	fss, err := OpenFS(&Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	})
+	assert.NoError(t, err)
+
+	put := func(key string, n int64) {
+		seg, err := NewSegment(key, types.NewNumber(n), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment(key, seg))
+	}
+
+	put("balance:a", 100)
+	put("balance:b", 0)
+
+	va, _, err := fss.FetchSegment("balance:a")
+	assert.NoError(t, err)
+	vb, _, err := fss.FetchSegment("balance:b")
+	assert.NoError(t, err)
+
+	// 其他客户端在事务提交之前修改了 balance:b
+	put("balance:b", 50)
+
+	transfer := func() *WriteBatch {
+		batch := NewWriteBatch()
+		a, err := NewSegment("balance:a", types.NewNumber(90), 0)
+		assert.NoError(t, err)
+		b, err := NewSegment("balance:b", types.NewNumber(10), 0)
+		assert.NoError(t, err)
+		batch.Put("balance:a", a)
+		batch.Put("balance:b", b)
+		return batch
+	}
+
+	watches := []Watch{
+		{Key: "balance:a", Version: va, Exists: true},
+		{Key: "balance:b", Version: vb, Exists: true},
+		{Key: "lock", Exists: false},
+	}
+
+	err = fss.WriteBatchIf(watches, transfer())
+	var conflict *ConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, []string{"balance:b"}, conflict.Keys)
+
+	// 冲突的事务不能写入任何数据
+	_, seg, err := fss.FetchSegment("balance:a")
+	assert.NoError(t, err)
+	number, err := seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), number.Value)
+
+	vb, _, err = fss.FetchSegment("balance:b")
+	assert.NoError(t, err)
+	watches[1].Version = vb
+	assert.NoError(t, fss.WriteBatchIf(watches, transfer()))
+
+	// 提交之后版本号发生变化
+	newVersion, seg, err := fss.FetchSegment("balance:b")
+	assert.NoError(t, err)
+	assert.NotEqual(t, vb, newVersion)
+	number, err = seg.ToNumber()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), number.Value)
+
+	put("lock", 1)
+	err = fss.WriteBatchIf([]Watch{{Key: "lock", Exists: false}}, NewWriteBatch())
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, []string{"lock"}, conflict.Keys)
+
+	assert.NoError(t, fss.CloseFS())
+}
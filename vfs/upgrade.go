@@ -0,0 +1,303 @@
+package vfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/auula/wiredkv/utils"
+)
+
+const upgradeFileExtension = ".upgrade"
+
+const (
+	UpgradeScan    = "scan"    // Reading the segments of a region
+	UpgradeRewrite = "rewrite" // Writing a region in the current format
+	UpgradeIndex   = "index"   // Rebuilding index.wdb from the upgraded regions
+)
+
+// UpgradeProgress is reported by UpgradeFS after each step, Done of Total regions
+// have finished the stage. Segments is the number of segments of the region.
+type UpgradeProgress struct {
+	Stage    string
+	RegionID uint64
+	Segments int
+	Done     int
+	Total    int
+}
+
+type upgradeRegion struct {
+	regionID uint64
+	version  uint8
+	path     string
+	segments []*upgradeSegment
+}
+
+type upgradeSegment struct {
+	offset    uint64
+	createdAt uint64
+	lsn       uint64
+}
+
+// UpgradeFS rewrites the regions of the directory opt.Path that use an older format
+// version to the current one and rebuilds index.wdb, it returns the number of regions
+// rewritten. It works offline, the directory must not be opened by OpenFS meanwhile.
+// Values are copied as they were written, no secret is needed for encrypted regions.
+// Formats before version 4 do not record the codec of a value, legacy is recorded
+// for them instead, the compressor and encryptor that were enabled for the directory.
+//
+// Formats before version 3 have no LSN, recovery kept the segment with the newest
+// CreatedAt and on a tie the later one. The LSNs are assigned in that order, so the
+// upgraded regions recover to the same index. An interrupted upgrade can simply be
+// run again.
+func UpgradeFS(opt *Options, legacy Codec, progress func(UpgradeProgress)) (int, error) {
+	if !utils.IsExist(opt.Path) {
+		return 0, fmt.Errorf("data directory %s does not exist", opt.Path)
+	}
+
+	if progress == nil {
+		progress = func(UpgradeProgress) {}
+	}
+
+	regions, err := listUpgradeRegions(opt.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	outdated, sequenced := false, true
+	for _, region := range regions {
+		if region.version < FormatVersion {
+			outdated = true
+		}
+		if region.version < 3 {
+			sequenced = false
+		}
+	}
+	if !outdated {
+		return 0, nil
+	}
+
+	var segments []*upgradeSegment
+	for i, region := range regions {
+		err := scanUpgradeRegion(region)
+		if err != nil {
+			return 0, err
+		}
+		segments = append(segments, region.segments...)
+		progress(UpgradeProgress{
+			Stage:    UpgradeScan,
+			RegionID: region.regionID,
+			Segments: len(region.segments),
+			Done:     i + 1,
+			Total:    len(regions),
+		})
+	}
+
+	// Regions without LSN were never opened by a build that assigns them, the regions
+	// with LSN next to them are the output of an interrupted upgrade and are ordered
+	// again, their CreatedAt and position did not change.
+	if !sequenced {
+		// Regions are scanned in ascending order, the stable sort keeps the replay order on a tie.
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].createdAt < segments[j].createdAt
+		})
+		for i, segment := range segments {
+			segment.lsn = uint64(i + 1)
+		}
+	}
+
+	for i, region := range regions {
+		err := rewriteUpgradeRegion(region, legacy)
+		if err != nil {
+			return 0, err
+		}
+		progress(UpgradeProgress{
+			Stage:    UpgradeRewrite,
+			RegionID: region.regionID,
+			Segments: len(region.segments),
+			Done:     i + 1,
+			Total:    len(regions),
+		})
+	}
+
+	// Positions change with the header size, the old snapshot must not be used.
+	err = os.Remove(filepath.Join(opt.Path, indexFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("failed to remove index snapshot: %w", err)
+	}
+
+	for _, region := range regions {
+		err := os.Rename(region.path+upgradeFileExtension, region.path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to replace region %d: %w", region.regionID, err)
+		}
+	}
+
+	err = utils.SyncDir(opt.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	// A full scan of the upgraded regions rebuilds the index, it is exported on close.
+	fss, err := OpenFS(opt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open upgraded regions: %w", err)
+	}
+
+	err = fss.CloseFS()
+	if err != nil {
+		return 0, fmt.Errorf("failed to export upgraded index: %w", err)
+	}
+
+	progress(UpgradeProgress{Stage: UpgradeIndex, Done: len(regions), Total: len(regions)})
+
+	return len(regions), nil
+}
+
+// listUpgradeRegions returns the regions of path in ascending order and removes
+// the output of an interrupted upgrade.
+func listUpgradeRegions(path string) ([]*upgradeRegion, error) {
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var regions []*upgradeRegion
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(file.Name(), fileExtension+upgradeFileExtension) {
+			err := os.Remove(filepath.Join(path, file.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove unfinished upgrade region: %w", err)
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(file.Name(), fileExtension) || !strings.HasPrefix(file.Name(), "0") {
+			continue
+		}
+
+		regionID, err := parseDataFileName(file.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region id: %w", err)
+		}
+
+		region := &upgradeRegion{
+			regionID: regionID,
+			path:     filepath.Join(path, file.Name()),
+		}
+
+		fd, err := os.Open(region.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open data file: %w", err)
+		}
+		region.version, err = regionVersion(fd)
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		regions = append(regions, region)
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].regionID < regions[j].regionID
+	})
+
+	return regions, nil
+}
+
+// scanUpgradeRegion collects the position, creation time and LSN of the segments of region.
+func scanUpgradeRegion(region *upgradeRegion) error {
+	fd, err := os.Open(region.path)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer fd.Close()
+
+	finfo, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	end := uint64(finfo.Size())
+	padding := segmentHeaderSizes[region.version]
+	offset := uint64(len(dataFileMetadata))
+	for offset < end {
+		size, err := segmentSize(fd, offset, end, padding)
+		var seg *Segment
+		if err == nil {
+			seg, err = readRawSegment(fd, offset, padding)
+		}
+
+		if err != nil {
+			// A torn append at the end of a region is dropped, recovery would have truncated it.
+			if errors.Is(err, errIncompleteSegment) || offset+size == end {
+				break
+			}
+			return fmt.Errorf("corrupted segment in region %d at offset %d: %w", region.regionID, offset, err)
+		}
+
+		region.segments = append(region.segments, &upgradeSegment{
+			offset:    offset,
+			createdAt: seg.CreatedAt,
+			lsn:       seg.LSN,
+		})
+		offset += size
+	}
+
+	return nil
+}
+
+// rewriteUpgradeRegion writes the segments of region in the current format next to it.
+func rewriteUpgradeRegion(region *upgradeRegion, legacy Codec) error {
+	src, err := os.Open(region.path)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := createRegionFile(region.path + upgradeFileExtension)
+	if err != nil {
+		return fmt.Errorf("failed to create upgrade region: %w", err)
+	}
+	defer dst.Close()
+
+	padding := segmentHeaderSizes[region.version]
+	writer := bufio.NewWriterSize(dst, 4*MB)
+	for _, segment := range region.segments {
+		seg, err := readRawSegment(src, segment.offset, padding)
+		if err != nil {
+			return fmt.Errorf("failed to read segment in region %d at offset %d: %w", region.regionID, segment.offset, err)
+		}
+
+		seg.LSN = segment.lsn
+		// Tombstones and batch markers carry no encoded value.
+		if region.version < 4 && seg.Tombstone == 0 {
+			seg.Codec = legacy
+		}
+		bytes, err := serializedSegment(seg)
+		if err != nil {
+			return err
+		}
+
+		_, err = writer.Write(bytes)
+		if err != nil {
+			return fmt.Errorf("failed to write upgrade region: %w", err)
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write upgrade region: %w", err)
+	}
+
+	return dst.Sync()
+}
@@ -0,0 +1,160 @@
+package vfs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/auula/wiredkv/conf"
+	"github.com/auula/wiredkv/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacySegment 按照旧的格式版本序列化数据段，旧版本没有 SLD 和 LSN 字段
+func legacySegment(t *testing.T, version uint8, seg *Segment) []byte {
+	bytes, err := serializedSegment(seg)
+	assert.NoError(t, err)
+
+	padding := segmentHeaderSizes[version]
+	legacy := append([]byte{}, bytes[:padding]...)
+	legacy = append(legacy, bytes[SEGMENT_PADDING:len(bytes)-4]...)
+	return binary.LittleEndian.AppendUint32(legacy, crc32.ChecksumIEEE(legacy))
+}
+
+func TestUpgradeFS(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	text := func(key, content string, createdAt uint64) *Segment {
+		seg, err := NewSegment(key, *types.NewText(content), 0)
+		assert.NoError(t, err)
+		seg.CreatedAt = createdAt
+		return seg
+	}
+	tombstone := NewTombstoneSegment("b")
+	tombstone.CreatedAt = 300
+
+	// 第一个区域是版本 1，第二个区域是版本 2，末尾还有一个写了一半的数据段
+	region1 := []byte{0xDB, 0x00, 0x01, 0x01}
+	region1 = append(region1, legacySegment(t, 1, text("a", "a1", 100))...)
+	region1 = append(region1, legacySegment(t, 1, text("b", "b1", 200))...)
+	region1 = append(region1, legacySegment(t, 1, tombstone)...)
+	assert.NoError(t, os.WriteFile(filepath.Join(opt.Path, formatDataFileName(1)), region1, conf.FSPerm))
+
+	region2 := []byte{0xDB, 0x00, 0x01, 0x02}
+	region2 = append(region2, legacySegment(t, 2, text("a", "a2", 400))...)
+	region2 = append(region2, legacySegment(t, 2, text("c", "c1", 400))...)
+	torn := legacySegment(t, 2, text("d", "d1", 500))
+	region2 = append(region2, torn[:len(torn)-3]...)
+	assert.NoError(t, os.WriteFile(filepath.Join(opt.Path, formatDataFileName(2)), region2, conf.FSPerm))
+
+	// 旧版本的索引快照会在升级之后重新生成
+	assert.NoError(t, os.WriteFile(filepath.Join(opt.Path, indexFileName), []byte{0xDB, 0x00, 0x01, 0x05}, conf.FSPerm))
+
+	_, err := OpenFS(opt)
+	assert.ErrorIs(t, err, ErrOutdatedFormat)
+
+	var reports []UpgradeProgress
+	upgraded, err := UpgradeFS(opt, Codec{}, func(p UpgradeProgress) {
+		reports = append(reports, p)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, upgraded)
+	assert.Len(t, reports, 5)
+	assert.Equal(t, UpgradeProgress{Stage: UpgradeScan, RegionID: 2, Segments: 2, Done: 2, Total: 2}, reports[1])
+	assert.Equal(t, UpgradeIndex, reports[4].Stage)
+
+	fd, err := os.Open(filepath.Join(opt.Path, indexFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, validateFileHeader(fd, indexFileMetadata))
+	assert.NoError(t, fd.Close())
+
+	// 没有索引快照的时候全量扫描也能得到相同的结果
+	for i := 0; i < 2; i++ {
+		fss, err := OpenFS(opt)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, fss.KeysCount())
+
+		lsn, seg, err := fss.FetchSegment("a")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), lsn)
+		value, err := seg.ToText()
+		assert.NoError(t, err)
+		assert.Equal(t, "a2", value.Content)
+
+		lsn, _, err = fss.FetchSegment("c")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(5), lsn)
+
+		_, _, err = fss.FetchSegment("b")
+		assert.Error(t, err)
+		_, _, err = fss.FetchSegment("d")
+		assert.Error(t, err)
+
+		// 新的写入接着之前最大的 LSN
+		seg, err = NewSegment("e", *types.NewText("e1"), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fss.PutSegment("e", seg))
+		lsn, _, err = fss.FetchSegment("e")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6+2*i), lsn)
+		assert.NoError(t, fss.DeleteSegment("e"))
+
+		assert.NoError(t, fss.CloseFS())
+		assert.NoError(t, os.Remove(filepath.Join(opt.Path, indexFileName)))
+	}
+
+	// 已经是当前版本的目录不需要升级
+	upgraded, err = UpgradeFS(opt, Codec{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, upgraded)
+}
+
+func TestUpgradeFSLegacyCodec(t *testing.T) {
+	opt := &Options{
+		FSPerm:    conf.FSPerm,
+		Path:      t.TempDir(),
+		Threshold: conf.Settings.Region.Threshold,
+	}
+
+	// 版本 3 的数据没有记录编码方式，写入的时候开启了压缩
+	text := func(key, content string, lsn uint64) []byte {
+		seg, err := NewSegment(key, *types.NewText(content), 0)
+		assert.NoError(t, err)
+		seg.Value, err = SnappyCompressor.Compress(seg.Value)
+		assert.NoError(t, err)
+		seg.ValueSize = uint32(len(seg.Value))
+		seg.LSN = lsn
+		return legacySegment(t, 3, seg)
+	}
+
+	region := []byte{0xDB, 0x00, 0x01, 0x03}
+	region = append(region, text("a", "a1", 7)...)
+	region = append(region, text("b", "b1", 3)...)
+	assert.NoError(t, os.WriteFile(filepath.Join(opt.Path, formatDataFileName(1)), region, conf.FSPerm))
+
+	upgraded, err := UpgradeFS(opt, Codec{Compressor: CodecSnappy}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, upgraded)
+
+	// 已有的 LSN 保持不变，当前没有开启压缩也能读取旧的数据
+	fss, err := OpenFS(opt)
+	assert.NoError(t, err)
+	lsn, seg, err := fss.FetchSegment("a")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), lsn)
+	assert.Equal(t, Codec{Compressor: CodecSnappy}, seg.Codec)
+	value, err := seg.ToText()
+	assert.NoError(t, err)
+	assert.Equal(t, "a1", value.Content)
+
+	lsn, _, err = fss.FetchSegment("b")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, fss.CloseFS())
+}